@@ -0,0 +1,383 @@
+package engine
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/// the default size of the LRU cache created when the engine init
+var DefaultCacheSize = 1024
+
+/// the second-level cache of the query results, the namespace is the sql map namespace
+/// of the statement, all the entries of the namespace are removed when it is flushed
+type Cache interface {
+	/// get the cached value, false if not found or expired
+	Get(namespace, key string) (interface{}, bool)
+	/// put the value to the cache, ttl 0 for no expiration
+	Put(namespace, key string, value interface{}, ttl time.Duration)
+	/// remove all the entries of the namespace
+	Flush(namespace string)
+}
+
+/// the entry of the LRU cache
+type lruItem struct {
+	namespace string
+	key       string
+	value     interface{}
+	expire    time.Time
+}
+
+/// the in-process LRU cache, the least recently used entry is removed when it is full
+type lruCache struct {
+	lock  sync.Mutex
+	size  int
+	list  *list.List
+	items map[string]*list.Element
+}
+
+/// create a LRU cache
+/// @param size: the max entries of the cache
+func NewLRUCache(size int) Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &lruCache{
+		size:  size,
+		list:  list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+/// get the cached value, false if not found or expired
+func (c *lruCache) Get(namespace, key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el := c.items[namespace+"\x00"+key]
+	if el == nil {
+		return nil, false
+	}
+	item := el.Value.(*lruItem)
+	if !item.expire.IsZero() && time.Now().After(item.expire) {
+		c.remove(el)
+		return nil, false
+	}
+	c.list.MoveToFront(el)
+	return item.value, true
+}
+
+/// put the value to the cache, ttl 0 for no expiration
+func (c *lruCache) Put(namespace, key string, value interface{}, ttl time.Duration) {
+	item := &lruItem{namespace: namespace, key: key, value: value}
+	if ttl > 0 {
+		item.expire = time.Now().Add(ttl)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	k := namespace + "\x00" + key
+	if el := c.items[k]; el != nil {
+		el.Value = item
+		c.list.MoveToFront(el)
+		return
+	}
+	c.items[k] = c.list.PushFront(item)
+	for c.list.Len() > c.size {
+		c.remove(c.list.Back())
+	}
+}
+
+/// remove all the entries of the namespace
+func (c *lruCache) Flush(namespace string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for el := c.list.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*lruItem).namespace == namespace {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+/// remove the entry from the list and the map
+func (c *lruCache) remove(el *list.Element) {
+	item := el.Value.(*lruItem)
+	delete(c.items, item.namespace+"\x00"+item.key)
+	c.list.Remove(el)
+}
+
+/// set the cache of the query results, the default is the LRU cache of DefaultCacheSize
+/// @param c: the cache, nil to disable the cache
+func (s *SqlEngine) SetCache(c Cache) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cache = c
+}
+
+/// get the cache of the query results, nil if the cache is disabled
+func (s *SqlEngine) getCache() Cache {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cache
+}
+
+/// the namespaces flushed in the transaction, they are flushed again when the transaction end,
+/// the query in the transaction not use the cache
+type txCache struct {
+	lock       sync.Mutex
+	namespaces map[string]bool
+}
+
+/// add the flushed namespaces
+func (t *txCache) add(namespaces []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, ns := range namespaces {
+		t.namespaces[ns] = true
+	}
+}
+
+/// get the flushed namespaces
+func (t *txCache) list() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make([]string, 0, len(t.namespaces))
+	for ns := range t.namespaces {
+		ret = append(ret, ns)
+	}
+	return ret
+}
+
+/// get the cache the query use, nil if the query can't use the cache,
+/// the query in the transaction or routed to the primary db not use the cache,
+/// as the results cached by the replicas may be behind the primary
+/// @param ctx: the context of the execution
+/// @param mapper: the sql template of the sql map key
+func (s *SqlEngine) queryCache(ctx context.Context, mapper *SqlTemplate) Cache {
+	if !mapper.attrs.useCache || txSession(ctx) != nil || isUseMaster(ctx) {
+		return nil
+	}
+	return s.getCache()
+}
+
+/// flush the cache of the namespaces that the write statement flush
+/// @param ctx: the context of the execution
+/// @param mapper: the sql template of the write statement
+func (s *SqlEngine) flushCache(ctx context.Context, mapper *SqlTemplate) {
+	if len(mapper.flushes) == 0 || s.getCache() == nil {
+		return
+	}
+	s.flushNamespaces(mapper.flushes)
+	if session := txSession(ctx); session != nil {
+		session.txCache.add(mapper.flushes)
+	}
+}
+
+/// flush the cache of the namespaces
+/// @param namespaces: the namespaces to flush
+func (s *SqlEngine) flushNamespaces(namespaces []string) {
+	cache := s.getCache()
+	if cache == nil {
+		return
+	}
+	for _, ns := range namespaces {
+		cache.Flush(ns)
+	}
+}
+
+/// get the rows from the cache, or query and put the rows to the cache
+/// @param ctx: the context of the execution
+/// @param cache: the cache of the query results
+/// @param mapper: the sql template of the sql map key
+/// @param sqlStr: the sql to execute
+/// @param args: the args bound to the sql
+/// @param f: the execute func like eg: db.QueryContext/tx.QueryContext
+func (s *SqlEngine) cachedRows(ctx context.Context, cache Cache, mapper *SqlTemplate, sqlStr string, args []interface{}, f queryFunc) (*sql.Rows, error) {
+	key := cacheKey(mapper.key, sqlStr, args)
+	if v, ok := cache.Get(mapper.namespace, key); ok {
+		if entry, ok := v.(*cacheEntry); ok {
+			return entry.rows(ctx)
+		}
+	}
+
+	rows, err := f(ctx, s.comment(ctx, mapper.key, sqlStr), args...)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := newCacheEntry(rows, mapper.attrs.maxRows)
+	if err != nil {
+		return nil, err
+	}
+	cache.Put(mapper.namespace, key, entry, mapper.attrs.ttl)
+	return entry.rows(ctx)
+}
+
+/// make the cache key by the statement key, the rendered sql and the bound args,
+/// the pointer args are dereferenced to make the key by the value not the address
+func cacheKey(key, sqlStr string, args []interface{}) string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(key)
+	buf.WriteByte(0)
+	buf.WriteString(sqlStr)
+	for _, arg := range args {
+		if v := reflect.ValueOf(arg); v.Kind() == reflect.Ptr {
+			if v = deRefValue(v); v.IsValid() && v.CanInterface() {
+				arg = v.Interface()
+			} else {
+				arg = nil
+			}
+		}
+		fmt.Fprintf(buf, "\x00%T:%v", arg, arg)
+	}
+	return buf.String()
+}
+
+/// the cached result set, it is replayed as *sql.Rows to scan the same way as the query
+type cacheEntry struct {
+	columns   []string
+	scanTypes []reflect.Type
+	dbTypes   []string
+	values    [][]interface{}
+}
+
+/// read the rows to the cache entry and close the rows
+/// @param rows: the result set
+/// @param maxRows: the max rows of the sql, read one more row to report the error when replay
+func newCacheEntry(rows *sql.Rows, maxRows int) (*cacheEntry, error) {
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{
+		columns:   columns,
+		scanTypes: make([]reflect.Type, len(types)),
+		dbTypes:   make([]string, len(types)),
+		values:    make([][]interface{}, 0),
+	}
+	for i, ct := range types {
+		entry.scanTypes[i] = ct.ScanType()
+		entry.dbTypes[i] = ct.DatabaseTypeName()
+	}
+
+	holders := make([]interface{}, len(columns))
+	for rows.Next() {
+		row := make([]interface{}, len(columns))
+		for i := range row {
+			holders[i] = &row[i]
+		}
+		err = rows.Scan(holders...)
+		if err != nil {
+			return nil, err
+		}
+		entry.values = append(entry.values, row)
+		if maxRows > 0 && len(entry.values) > maxRows {
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+/// replay the cache entry as *sql.Rows
+func (e *cacheEntry) rows(ctx context.Context) (*sql.Rows, error) {
+	return replayDB.QueryContext(ctx, "", e)
+}
+
+/// the db to replay the cache entries
+var replayDB = sql.OpenDB(replayConnector{})
+
+/// the connector of the db to replay the cache entries
+type replayConnector struct{}
+
+func (replayConnector) Connect(context.Context) (driver.Conn, error) {
+	return replayConn{}, nil
+}
+
+func (replayConnector) Driver() driver.Driver {
+	return replayDriver{}
+}
+
+/// the driver of the db to replay the cache entries
+type replayDriver struct{}
+
+func (replayDriver) Open(string) (driver.Conn, error) {
+	return replayConn{}, nil
+}
+
+/// the conn to replay the cache entries, the query arg is the *cacheEntry
+type replayConn struct{}
+
+func (replayConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("the cache conn can't prepare")
+}
+
+func (replayConn) Close() error {
+	return nil
+}
+
+func (replayConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("the cache conn can't begin transaction")
+}
+
+func (replayConn) CheckNamedValue(*driver.NamedValue) error {
+	return nil
+}
+
+func (replayConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) != 1 {
+		return nil, errors.New("the cache conn must query with the cache entry")
+	}
+	entry, ok := args[0].Value.(*cacheEntry)
+	if !ok {
+		return nil, errors.New("the cache conn must query with the cache entry")
+	}
+	return &replayRows{entry: entry}, nil
+}
+
+/// the rows to replay the cache entry
+type replayRows struct {
+	entry *cacheEntry
+	index int
+}
+
+func (r *replayRows) Columns() []string {
+	return r.entry.columns
+}
+
+func (r *replayRows) Close() error {
+	return nil
+}
+
+func (r *replayRows) Next(dest []driver.Value) error {
+	if r.index >= len(r.entry.values) {
+		return io.EOF
+	}
+	for i, v := range r.entry.values[r.index] {
+		dest[i] = v
+	}
+	r.index++
+	return nil
+}
+
+func (r *replayRows) ColumnTypeScanType(index int) reflect.Type {
+	return r.entry.scanTypes[index]
+}
+
+func (r *replayRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.entry.dbTypes[index]
+}
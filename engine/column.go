@@ -0,0 +1,272 @@
+package engine
+
+import (
+	"database/sql"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/// the kind of the go value that the column value will be converted to
+type columnKind int
+
+const (
+	columnUnknown columnKind = iota // keep the value returned by the driver
+	columnInt                       // int64
+	columnUint                      // int64, or uint64 if overflow
+	columnFloat                     // float64
+	columnBool                      // bool
+	columnTime                      // time.Time
+	columnString                    // string
+	columnBytes                     // []byte
+)
+
+/// the layouts to parse the time column returned as text
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02",
+}
+
+/// the kinds of the database type names, the name is matched exactly without the length and UNSIGNED
+var columnTypeKinds = map[string]columnKind{
+	"TINYINT": columnInt, "SMALLINT": columnInt, "MEDIUMINT": columnInt, "INT": columnInt, "INTEGER": columnInt,
+	"BIGINT": columnInt, "INT2": columnInt, "INT4": columnInt, "INT8": columnInt, "YEAR": columnInt,
+	"SMALLSERIAL": columnInt, "SERIAL": columnInt, "BIGSERIAL": columnInt,
+	"FLOAT": columnFloat, "DOUBLE": columnFloat, "DOUBLE PRECISION": columnFloat, "REAL": columnFloat,
+	"FLOAT4": columnFloat, "FLOAT8": columnFloat,
+	"BOOL": columnBool, "BOOLEAN": columnBool,
+	"DATE": columnTime, "DATETIME": columnTime, "DATETIME2": columnTime, "SMALLDATETIME": columnTime,
+	"DATETIMEOFFSET": columnTime, "TIMESTAMP": columnTime, "TIMESTAMPTZ": columnTime,
+	"BIT": columnBytes, "BINARY": columnBytes, "VARBINARY": columnBytes, "BYTEA": columnBytes, "IMAGE": columnBytes,
+	"BLOB": columnBytes, "TINYBLOB": columnBytes, "MEDIUMBLOB": columnBytes, "LONGBLOB": columnBytes,
+	"TIME": columnString, "CHAR": columnString, "VARCHAR": columnString, "NCHAR": columnString,
+	"NVARCHAR": columnString, "VARCHAR2": columnString, "NVARCHAR2": columnString, "BPCHAR": columnString,
+	"TEXT": columnString, "TINYTEXT": columnString, "MEDIUMTEXT": columnString, "LONGTEXT": columnString,
+	"NTEXT": columnString, "CLOB": columnString, "NCLOB": columnString, "JSON": columnString, "JSONB": columnString,
+	"DECIMAL": columnString, "NUMERIC": columnString, "ENUM": columnString, "SET": columnString, "UUID": columnString,
+}
+
+/// the sql.RawBytes type
+var rawBytesType = reflect.TypeOf(sql.RawBytes{})
+
+/// get the kinds of the columns by the column types
+/// @param types: the column types of the result set
+func columnKinds(types []*sql.ColumnType) []columnKind {
+	kinds := make([]columnKind, len(types))
+	for i, ct := range types {
+		kinds[i] = detectColumnKind(ct)
+	}
+	return kinds
+}
+
+/// detect the kind of the column by the scan type, or by the database type name
+/// when the scan type is bytes or unknown
+func detectColumnKind(ct *sql.ColumnType) columnKind {
+	typ := ct.ScanType()
+	if typ != nil {
+		typ = deRefType(typ)
+		// the null type like sql.NullInt64, use the type of the value field
+		if typ.Kind() == reflect.Struct && typ != timeType && typ.NumField() == 2 {
+			if f, ok := typ.FieldByName("Valid"); ok && f.Type.Kind() == reflect.Bool {
+				if f.Index[0] == 0 {
+					typ = typ.Field(1).Type
+				} else {
+					typ = typ.Field(0).Type
+				}
+			}
+		}
+		switch typ.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return columnInt
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return columnUint
+		case reflect.Float32, reflect.Float64:
+			return columnFloat
+		case reflect.Bool:
+			return columnBool
+		case reflect.String:
+			return columnString
+		case reflect.Struct:
+			if typ == timeType {
+				return columnTime
+			}
+		}
+	}
+
+	name := strings.ToUpper(strings.TrimSpace(ct.DatabaseTypeName()))
+	if i := strings.Index(name, "("); i >= 0 {
+		name = strings.TrimSpace(name[:i])
+	}
+	unsigned := strings.HasPrefix(name, "UNSIGNED ")
+	if kind, ok := columnTypeKinds[strings.TrimPrefix(name, "UNSIGNED ")]; ok {
+		if unsigned && kind == columnInt {
+			return columnUint
+		}
+		return kind
+	}
+	if typ == rawBytesType {
+		return columnBytes
+	}
+	return columnUnknown
+}
+
+/// convert the value returned by the driver to the go value of the column kind,
+/// the NULL is converted to nil
+/// @param kind: the kind of the column
+/// @param val: the value returned by the driver
+func convertColumnValue(kind columnKind, val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		if kind == columnBytes || kind == columnUnknown {
+			return v, nil
+		}
+		typed, err := convertColumnText(kind, string(v))
+		if err != nil {
+			// the type name is not what the value is, keep the value returned by the driver
+			return v, nil
+		}
+		return typed, nil
+	case string:
+		if kind == columnString || kind == columnUnknown {
+			return v, nil
+		}
+		if kind == columnBytes {
+			return []byte(v), nil
+		}
+		typed, err := convertColumnText(kind, v)
+		if err != nil {
+			return v, nil
+		}
+		return typed, nil
+	case int64:
+		switch kind {
+		case columnBool:
+			return v != 0, nil
+		case columnFloat:
+			return float64(v), nil
+		}
+	case float32:
+		return float64(v), nil
+	}
+	return val, nil
+}
+
+/// convert the text value to the go value of the column kind
+/// @param kind: the kind of the column
+/// @param text: the text value returned by the driver
+func convertColumnText(kind columnKind, text string) (interface{}, error) {
+	switch kind {
+	case columnInt:
+		return strconv.ParseInt(text, 10, 64)
+	case columnUint:
+		u, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if u > 1<<63-1 {
+			return u, nil
+		}
+		return int64(u), nil
+	case columnFloat:
+		return strconv.ParseFloat(text, 64)
+	case columnBool:
+		return strconv.ParseBool(text)
+	case columnTime:
+		if strings.HasPrefix(text, "0000-00-00") {
+			return time.Time{}, nil
+		}
+		for _, layout := range timeLayouts {
+			t, err := time.Parse(layout, text)
+			if err == nil {
+				return t, nil
+			}
+		}
+		// the time column like TIME can not be parsed, keep the text
+		return text, nil
+	}
+	return text, nil
+}
+
+/// scan the current row to the typed values
+/// @param rows: the result set
+/// @param kinds: the kinds of the columns
+func scanTypedRow(rows *sql.Rows, kinds []columnKind) ([]interface{}, error) {
+	values := make([]interface{}, len(kinds))
+	holders := make([]interface{}, len(kinds))
+	for i := range values {
+		holders[i] = &values[i]
+	}
+	err := rows.Scan(holders...)
+	if err != nil {
+		return nil, err
+	}
+	for i, kind := range kinds {
+		values[i], err = convertColumnValue(kind, values[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+/// convert sql.Rows to the columns and the typed values of the rows
+/// @param rows: *sql.Rows
+/// @param maxRows: the max rows to read, 0 for no limit
+/// @return []string: the columns
+/// @return [][]interface{}: the rows
+/// @return error
+func convertRows2SliceTyped(rows *sql.Rows, maxRows int) ([]string, [][]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, nil, err
+	}
+	kinds := columnKinds(types)
+	rs := make([][]interface{}, 0)
+	count := 0
+	for rows.Next() {
+		count++
+		err = checkMaxRows(count, maxRows)
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := scanTypedRow(rows, kinds)
+		if err != nil {
+			return nil, nil, err
+		}
+		rs = append(rs, r)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return cols, rs, nil
+}
+
+/// convert sql.Rows to []map[string]interface{}
+/// @param rows: *sql.Rows
+/// @param maxRows: the max rows to read, 0 for no limit
+/// @return []map[string]interface{}
+/// @return error
+func convertRows2SliceMapTyped(rows *sql.Rows, maxRows int) ([]map[string]interface{}, error) {
+	cols, rs, err := convertRows2SliceTyped(rows, maxRows)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]map[string]interface{}, 0, len(rs))
+	for _, row := range rs {
+		m := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			m[col] = row[i]
+		}
+		ret = append(ret, m)
+	}
+	return ret, nil
+}
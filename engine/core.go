@@ -2,42 +2,56 @@ package engine
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"github.com/zhaobingss/sqlmap/log"
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 )
 
-/// the sql default namespace
+/// the sql default namespace of the new engine
 var DefaultNamespace = "default_namespace"
 
-/// cache sql template
-var sqlMap = map[string]*SqlTemplate{}
-
 /// the regex to be use replace space char in sql
 var reg, _ = regexp.Compile("\\s+")
 
-/// the template builder instance
-var tplBuilder TemplateBuilder
+/// the sql.Scanner type, the struct implement it will be scanned as a scalar
+var scannerType = reflect.TypeOf((*sql.Scanner)(nil)).Elem()
+
+/// the time.Time type, it will be scanned as a scalar
+var timeType = reflect.TypeOf(time.Time{})
+
+/// the []byte type, it will be scanned as a scalar
+var bytesType = reflect.TypeOf([]byte(nil))
 
-/// a temp var to receive the value that not define in struct
-var tmpVar = &[]byte{}
+/// the query func like eg: db.QueryContext/tx.QueryContext
+type queryFunc func(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+
+/// the exec func like eg: db.ExecContext/tx.ExecContext
+type execFunc func(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 
 /// the sql and sql template
 type SqlTemplate struct {
-	sql string   // sql content
-	tpl Template // template for generate the execute sql
+	key       string         // sql map key, namespace + sql ID
+	namespace string         // the namespace of the sql
+	sql       string         // sql content
+	tpl       Template       // template for generate the execute sql
+	marks     sqlMarks       // the marks of the dynamic elements in sql
+	resultMap *resultMap     // the result map to set the rows to struct, nil for the db tag
+	attrs     statementAttrs // the attributes of the sql enforced at execution time
+	flushes   []string       // the namespaces to flush the cache when the sql executed
 }
 
 /// convert sql.Rows to []map[string]string
 /// @param rows: *sql.Rows
+/// @param maxRows: the max rows to read, 0 for no limit
 /// @return []map[string]string
 /// @return error
-func convertRows2SliceMapString(rows *sql.Rows) ([]map[string]string, error) {
-	rs, cols, err := convertRows2SliceInterface(rows)
+func convertRows2SliceMapString(rows *sql.Rows, maxRows int) ([]map[string]string, error) {
+	rs, cols, err := convertRows2SliceInterface(rows, maxRows)
 	if err != nil {
 		return nil, err
 	}
@@ -47,10 +61,11 @@ func convertRows2SliceMapString(rows *sql.Rows) ([]map[string]string, error) {
 
 /// convert sql.Rows to []map[string][]byte
 /// @param rows: *sql.Rows
+/// @param maxRows: the max rows to read, 0 for no limit
 /// @return []map[string][]byte
 /// @return error
-func convertRows2SliceMapBytes(rows *sql.Rows) ([]map[string][]byte, error) {
-	rs, cols, err := convertRows2SliceInterface(rows)
+func convertRows2SliceMapBytes(rows *sql.Rows, maxRows int) ([]map[string][]byte, error) {
+	rs, cols, err := convertRows2SliceInterface(rows, maxRows)
 	if err != nil {
 		return nil, err
 	}
@@ -60,16 +75,23 @@ func convertRows2SliceMapBytes(rows *sql.Rows) ([]map[string][]byte, error) {
 
 /// convert sql.Rows to [][]interface{}
 /// @param rows: *sql.Rows
+/// @param maxRows: the max rows to read, 0 for no limit
 /// @return [][]interface{}
 /// @return error
-func convertRows2SliceInterface(rows *sql.Rows) ([][]interface{}, []string, error) {
+func convertRows2SliceInterface(rows *sql.Rows, maxRows int) ([][]interface{}, []string, error) {
 	cols, err := rows.Columns()
 	if err != nil {
 		return nil, nil, err
 	}
 	size := len(cols)
 	rs := make([][]interface{}, 0)
+	count := 0
 	for rows.Next() {
+		count++
+		err = checkMaxRows(count, maxRows)
+		if err != nil {
+			return nil, nil, err
+		}
 		r := makeEmptyRow(size)
 		err = rows.Scan(r...)
 		if err != nil {
@@ -78,6 +100,9 @@ func convertRows2SliceInterface(rows *sql.Rows) ([][]interface{}, []string, erro
 			rs = append(rs, r)
 		}
 	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
 	return rs, cols, nil
 }
 
@@ -127,137 +152,320 @@ func convertMapString(rows [][]interface{}, cols []string) []map[string]string {
 	return ret
 }
 
-/// build sql for execute
+/// get the sql template by the key
 /// @param key: sql map key, namespace + sql ID
-/// @param param: the param to pass to the sql template
-func buildSql(key string, param interface{}) (string, error) {
+func (s *SqlEngine) getSqlTemplate(key string) (*SqlTemplate, error) {
 	if key == "" {
-		return "", errors.New("the map key must be not empty")
+		return nil, errors.New("the map key must be not empty")
 	}
-	mapper := sqlMap[key]
+	s.lock.RLock()
+	mapper := s.sqlMap[key]
+	s.lock.RUnlock()
 	if mapper == nil {
-		return "", errors.New("can't match the map key: " + key)
+		return nil, errors.New("can't match the map key: " + key)
 	}
+	return mapper, nil
+}
 
-	tpl, err := getAndSetTemplate(key, mapper)
+/// build sql for execute
+/// @param mapper: the sql template of the sql map key
+/// @param param: the param to pass to the sql template
+/// @return string: the sql to execute
+/// @return []interface{}: the args bound by #{name}
+/// @return error
+func (s *SqlEngine) buildSql(mapper *SqlTemplate, param interface{}) (string, []interface{}, error) {
+	tpl, err := s.getAndSetTemplate(mapper)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	bts := &bytes.Buffer{}
 	err = tpl.Execute(bts, param)
-	val := bts.String()
+	if err != nil {
+		return "", nil, err
+	}
+	val := reg.ReplaceAllString(bts.String(), " ")
+	val, err = mapper.marks.apply(val)
+	if err != nil {
+		return "", nil, err
+	}
 	val = strings.TrimSpace(val)
 	val = reg.ReplaceAllString(val, " ")
-	return val, err
+	return bindParams(val, mapper.marks.params, param, s.Dialect())
 }
 
 /// get or set sql template
-/// @param key: sql map key, namespace + sql ID
 /// @param mapper: SqlTemplate that store the sql map to Template
-func getAndSetTemplate(key string, mapper *SqlTemplate) (Template, error) {
+func (s *SqlEngine) getAndSetTemplate(mapper *SqlTemplate) (Template, error) {
+	s.lock.RLock()
 	tpl := mapper.tpl
-	var err error
-	if tpl == nil {
-		tpl, err = tplBuilder.New(key, mapper.sql)
+	s.lock.RUnlock()
+	if tpl != nil {
+		return tpl, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if mapper.tpl == nil {
+		tpl, err := s.tplBuilder.New(mapper.key, mapper.sql)
 		if err != nil {
 			return nil, err
-		} else {
-			mapper.tpl = tpl
 		}
+		mapper.tpl = tpl
 	}
-	return tpl, nil
+	return mapper.tpl, nil
 }
 
 /// query and fill the result to []map[string]string
+/// @param ctx: the context of the execution
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
-/// @param f: the execute func like eg: db.Query/db.Eexcute
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
 /// @return []map[string]string
 /// @return error
-func query(key string, param interface{}, f func(string, ...interface{}) (*sql.Rows, error)) ([]map[string]string, error) {
-	rows, err := queryRows(key, param, f)
+func (s *SqlEngine) query(ctx context.Context, key string, param interface{}, f queryFunc) ([]map[string]string, error) {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return nil, err
+	}
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
 	if err != nil {
 		return nil, err
 	}
-	m, err := convertRows2SliceMapString(rows)
+	defer rows.Close()
+	m, err := convertRows2SliceMapString(rows, mapper.attrs.maxRows)
+	exe.done(len(m), err)
 	if err != nil {
 		return nil, err
 	}
 	return m, nil
 }
 
+/// query and fill the result to []map[string]interface{}, the value is converted by the column type
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
+/// @return []map[string]interface{}
+/// @return error
+func (s *SqlEngine) queryMaps(ctx context.Context, key string, param interface{}, f queryFunc) ([]map[string]interface{}, error) {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return nil, err
+	}
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m, err := convertRows2SliceMapTyped(rows, mapper.attrs.maxRows)
+	exe.done(len(m), err)
+	return m, err
+}
+
+/// query and fill the result to []map[string][]byte
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
+/// @return []map[string][]byte
+/// @return error
+func (s *SqlEngine) queryBytes(ctx context.Context, key string, param interface{}, f queryFunc) ([]map[string][]byte, error) {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return nil, err
+	}
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m, err := convertRows2SliceMapBytes(rows, mapper.attrs.maxRows)
+	exe.done(len(m), err)
+	return m, err
+}
+
+/// query and fill the result to the columns and [][]interface{} in the column order,
+/// the value is converted by the column type
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
+/// @return []string: the columns
+/// @return [][]interface{}: the rows
+/// @return error
+func (s *SqlEngine) querySlice(ctx context.Context, key string, param interface{}, f queryFunc) ([]string, [][]interface{}, error) {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	cols, rs, err := convertRows2SliceTyped(rows, mapper.attrs.maxRows)
+	exe.done(len(rs), err)
+	return cols, rs, err
+}
+
 /// execute sql
+/// @param ctx: the context of the execution
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
-/// @param f: the execute func like eg: db.Query/db.Eexcute
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
 /// @return sql.Result
 /// @return error
-func exec(key string, param interface{}, f func(string, ...interface{}) (sql.Result, error)) (sql.Result, error) {
-	sqlStr, err := buildSql(key, param)
+func (s *SqlEngine) exec(ctx context.Context, key string, param interface{}, f execFunc) (sql.Result, error) {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return nil, err
+	}
+	err = mapper.attrs.checkExec()
+	if err != nil {
+		return nil, err
+	}
+	sqlStr, args, err := s.buildSql(mapper, param)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := f(sqlStr)
+	start := time.Now()
+	ctx, cancel := mapper.attrs.context(ctx)
+	defer cancel()
+	inv := &Invocation{
+		Key:       mapper.key,
+		SQL:       sqlStr,
+		Args:      args,
+		Operation: OperationExec,
+	}
+	ctx = s.startStatementSpan(ctx, inv)
+	err = s.intercept(ctx, inv, func(ctx context.Context, inv *Invocation) error {
+		result, err := f(ctx, s.comment(ctx, inv.Key, inv.SQL), inv.Args...)
+		inv.Result = result
+		return err
+	})
+	affected := int64(0)
+	if err == nil {
+		affected, _ = inv.Result.RowsAffected()
+	}
+	s.observe(ctx, inv, time.Since(start), "affected", affected, err)
 	if err != nil {
 		return nil, err
 	}
-	return result, nil
+	s.flushCache(ctx, mapper)
+	return inv.Result, nil
 }
 
 /// query and fill the result to *[]struct or *[]*struct
+/// @param ctx: the context of the execution
 /// @param dest: the slice struct that the rows will be set eg: *[]struct or *[]*struct
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
-/// @param f: the execute func like eg: db.Query/db.Eexcute
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
 /// @return error
-func selectRows(dest interface{}, key string, param interface{}, f func(string, ...interface{}) (*sql.Rows, error)) error {
-	rows, err := queryRows(key, param, f)
+func (s *SqlEngine) selectRows(ctx context.Context, dest interface{}, key string, param interface{}, f queryFunc) error {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return err
+	}
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
 	if err != nil {
 		return err
 	}
-	err = scanRows(dest, rows)
+	defer rows.Close()
+	count := sliceLen(dest)
+	err = scanRows(dest, rows, mapper.resultMap, mapper.attrs.maxRows)
+	exe.done(sliceLen(dest)-count, err)
 	return err
 }
 
 /// fill the result to *struct
+/// @param ctx: the context of the execution
 /// @param dest: the struct that the rows will be set eg: *struct
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
-/// @param f: the execute func like eg: db.Query/db.Eexcute
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
 /// @return error
-func selectRow(dest interface{}, key string, param interface{}, f func(string, ...interface{}) (*sql.Rows, error)) error {
-	rows, err := queryRows(key, param, f)
+func (s *SqlEngine) selectRow(ctx context.Context, dest interface{}, key string, param interface{}, f queryFunc) error {
+	mapper, err := s.getSqlTemplate(key)
 	if err != nil {
 		return err
 	}
-	return scanRow(dest, rows)
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	err = scanRow(dest, rows, mapper.resultMap, mapper.attrs.maxRows)
+	if err == nil {
+		exe.done(1, nil)
+	} else {
+		exe.done(0, err)
+	}
+	return err
 }
 
 /// query rows
-/// @param key: sql map key, namespace + sql ID
+/// @param ctx: the context of the execution
+/// @param mapper: the sql template of the sql map key
 /// @param param: the param to pass to the sql template
-/// @param f: the execute func like eg: db.Query/db.Eexcute
+/// @param f: the execute func like eg: db.QueryContext/db.ExecContext
 /// @return *sql.Rows
+/// @return *execution: call done after the rows consumed to release the timeout and log the sql
 /// @return error
-func queryRows(key string, param interface{}, f func(string, ...interface{}) (*sql.Rows, error)) (*sql.Rows, error) {
-	sqlStr, err := buildSql(key, param)
+func (s *SqlEngine) queryRows(ctx context.Context, mapper *SqlTemplate, param interface{}, f queryFunc) (*sql.Rows, *execution, error) {
+	err := mapper.attrs.checkQuery()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	if log.Info != nil {
-		log.Info(sqlStr)
+	sqlStr, args, err := s.buildSql(mapper, param)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	rows, err := f(sqlStr)
-	return rows, err
+	if mapper.attrs.useMaster {
+		ctx = UseMaster(ctx)
+	}
+	start := time.Now()
+	ctx, cancel := mapper.attrs.context(ctx)
+	inv := &Invocation{
+		Key:       mapper.key,
+		SQL:       sqlStr,
+		Args:      args,
+		Operation: OperationQuery,
+		FetchSize: mapper.attrs.fetchSize,
+	}
+	ctx = s.startStatementSpan(ctx, inv)
+	err = s.intercept(ctx, inv, func(ctx context.Context, inv *Invocation) error {
+		var err error
+		if cache := s.queryCache(ctx, mapper); cache != nil {
+			inv.Rows, err = s.cachedRows(ctx, cache, mapper, inv.SQL, inv.Args, f)
+		} else {
+			inv.Rows, err = f(ctx, s.comment(ctx, inv.Key, inv.SQL), inv.Args...)
+		}
+		return err
+	})
+	if err != nil {
+		cancel()
+		s.observe(ctx, inv, time.Since(start), "rows", 0, err)
+		return nil, nil, err
+	}
+	exe := &execution{
+		engine: s,
+		ctx:    ctx,
+		inv:    inv,
+		start:  start,
+		cancel: cancel,
+	}
+	return inv.Rows, exe, nil
 }
 
 /// set the result set to slice struct
 /// @param dest: the slice struct that the rows will be set eg: *[]struct or *[]*struct
 /// @param *sql.Rows
-func scanRows(dest interface{}, rows *sql.Rows) error {
+/// @param rm: the result map of the sql, nil for the db tag
+/// @param maxRows: the max rows to read, 0 for no limit
+func scanRows(dest interface{}, rows *sql.Rows, rm *resultMap, maxRows int) error {
 	val := reflect.ValueOf(dest)
 	err := checkScanRowsType(val.Type())
 	if err != nil {
@@ -272,11 +480,38 @@ func scanRows(dest interface{}, rows *sql.Rows) error {
 
 	isPtr := slice.Elem().Kind() == reflect.Ptr
 	base := deRefType(slice.Elem())
+	if isScalarType(base) {
+		return scanScalarRows(direct, rows, maxRows)
+	}
+	if rm.hasNested() {
+		ptrs, err := scanNestedRows(rows, rm, base, maxRows)
+		if err != nil {
+			return err
+		}
+		for _, vp := range ptrs {
+			if isPtr {
+				direct.Set(reflect.Append(direct, vp))
+			} else {
+				direct.Set(reflect.Append(direct, vp.Elem()))
+			}
+		}
+		return nil
+	}
+
 	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	count := 0
 	for rows.Next() {
+		count++
+		err = checkMaxRows(count, maxRows)
+		if err != nil {
+			return err
+		}
 		vp := reflect.New(base)
 		v := reflect.Indirect(vp)
-		fields, err := makeReflectRow(v, columns)
+		fields, err := makeReflectRow(v, columns, rm)
 		if err != nil {
 			return err
 		}
@@ -290,13 +525,15 @@ func scanRows(dest interface{}, rows *sql.Rows) error {
 			direct.Set(reflect.Append(direct, v))
 		}
 	}
-	return nil
+	return rows.Err()
 }
 
 /// set the result set to struct or struct pointer
 /// @param dest: the struct that the rows will be set eg: *struct
 /// @param *sql.Rows
-func scanRow(dest interface{}, rows *sql.Rows) error {
+/// @param rm: the result map of the sql, nil for the db tag
+/// @param maxRows: the max joined rows to read for the nested result map, 0 for no limit
+func scanRow(dest interface{}, rows *sql.Rows, rm *resultMap, maxRows int) error {
 	val := reflect.ValueOf(dest)
 	err := checkScanRowType(val.Type())
 	if err != nil {
@@ -304,12 +541,30 @@ func scanRow(dest interface{}, rows *sql.Rows) error {
 	}
 
 	direct := reflect.Indirect(val)
+	if isScalarType(direct.Type()) {
+		return scanScalarRow(direct, rows)
+	}
 	structType, err := detectBaseType(val.Type(), reflect.Struct)
 	if err != nil {
 		return err
 	}
 
 	base := deRefType(structType)
+	if rm.hasNested() {
+		ptrs, err := scanNestedRows(rows, rm, base, maxRows)
+		if err != nil {
+			return err
+		}
+		if len(ptrs) == 0 {
+			return ERR_NOT_GOT_RECORD
+		}
+		if len(ptrs) > 1 {
+			return ERR_MORE_THAN_ONE_RECORD
+		}
+		direct.Set(ptrs[0].Elem())
+		return nil
+	}
+
 	columns, err := rows.Columns()
 	if err != nil {
 		return err
@@ -323,7 +578,7 @@ func scanRow(dest interface{}, rows *sql.Rows) error {
 
 	vp := reflect.New(base)
 	v := reflect.Indirect(vp)
-	fields, err := makeReflectRow(v, columns)
+	fields, err := makeReflectRow(v, columns, rm)
 	if err != nil {
 		return err
 	}
@@ -341,11 +596,102 @@ func scanRow(dest interface{}, rows *sql.Rows) error {
 	return nil
 }
 
+/// set the single column result set to the slice of scalar
+/// @param direct: the slice value eg: []int64, []*string
+/// @param rows: the result set that must have one column
+/// @param maxRows: the max rows to read, 0 for no limit
+func scanScalarRows(direct reflect.Value, rows *sql.Rows, maxRows int) error {
+	err := checkScalarColumns(rows)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for rows.Next() {
+		count++
+		err = checkMaxRows(count, maxRows)
+		if err != nil {
+			return err
+		}
+		vp := reflect.New(direct.Type().Elem())
+		err = rows.Scan(vp.Interface())
+		if err != nil {
+			return err
+		}
+		direct.Set(reflect.Append(direct, vp.Elem()))
+	}
+	return rows.Err()
+}
+
+/// set the single row single column result set to the scalar
+/// @param direct: the scalar value eg: int64, time.Time, sql.NullString
+/// @param rows: the result set that must have one column
+func scanScalarRow(direct reflect.Value, rows *sql.Rows) error {
+	err := checkScalarColumns(rows)
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return ERR_NOT_GOT_RECORD
+	}
+	vp := reflect.New(direct.Type())
+	err = rows.Scan(vp.Interface())
+	if err != nil {
+		return err
+	}
+	if rows.Next() {
+		return ERR_MORE_THAN_ONE_RECORD
+	}
+	direct.Set(vp.Elem())
+	return nil
+}
+
+/// get the length of the slice dest
+/// @param dest: the slice dest eg: *[]struct
+func sliceLen(dest interface{}) int {
+	val := reflect.Indirect(reflect.ValueOf(dest))
+	if val.Kind() != reflect.Slice {
+		return 0
+	}
+	return val.Len()
+}
+
+/// check the result set has only one column to set to the scalar
+func checkScalarColumns(rows *sql.Rows) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if len(columns) != 1 {
+		return ERR_NOT_ONE_COLUMN
+	}
+	return nil
+}
+
+/// check if the type will be scanned as a scalar, the bool, number, string, []byte, time.Time
+/// and the type implement sql.Scanner are scalar, the map, slice, func and so on are not
+func isScalarType(typ reflect.Type) bool {
+	if typ == timeType || typ == bytesType || reflect.PtrTo(typ).Implements(scannerType) {
+		return true
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		return isScalarType(typ.Elem())
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
 /// make a columns slice to receive the rows scan result
-func makeReflectRow(val reflect.Value, columns []string) ([]interface{}, error) {
+func makeReflectRow(val reflect.Value, columns []string, rm *resultMap) ([]interface{}, error) {
 	fields := make([]interface{}, len(columns))
 	for i, column := range columns {
-		f, err := chooseReflectField(val, column)
+		f, err := chooseReflectField(val, column, rm)
 		if err != nil {
 			return nil, err
 		}
@@ -354,8 +700,11 @@ func makeReflectRow(val reflect.Value, columns []string) ([]interface{}, error)
 	return fields, nil
 }
 
-/// set the struct field to slice column
-func chooseReflectField(val reflect.Value, column string) (reflect.Value, error) {
+/// set the struct field to slice column, the result map property first then the db tag
+func chooseReflectField(val reflect.Value, column string, rm *resultMap) (reflect.Value, error) {
+	if property := rm.property(column); property != "" {
+		return propertyField(val, property)
+	}
 	val = reflect.Indirect(val)
 	fieldLen := val.NumField()
 	for i := 0; i < fieldLen; i++ {
@@ -365,7 +714,7 @@ func chooseReflectField(val reflect.Value, column string) (reflect.Value, error)
 			return fv, nil
 		}
 	}
-	return reflect.Indirect(reflect.ValueOf(tmpVar)), nil
+	return reflect.ValueOf(new(interface{})).Elem(), nil
 }
 
 /// check the dest type
@@ -376,15 +725,18 @@ func checkScanRowsType(typ reflect.Type) error {
 	if typ.Elem().Kind() != reflect.Slice {
 		return errors.New(`the obj must a pointer to slice`)
 	}
+	if isScalarType(typ.Elem().Elem()) {
+		return nil
+	}
 	if typ.Elem().Elem().Kind() == reflect.Ptr {
 		if typ.Elem().Elem().Elem().Kind() != reflect.Struct {
-			return errors.New(`the slice item must a struct or struct pointer`)
+			return errors.New(`the slice item must a struct, struct pointer or scalar`)
 		} else {
 			return nil
 		}
 	} else {
 		if typ.Elem().Elem().Kind() != reflect.Struct {
-			return errors.New(`the slice item must a struct or struct pointer`)
+			return errors.New(`the slice item must a struct, struct pointer or scalar`)
 		} else {
 			return nil
 		}
@@ -396,8 +748,8 @@ func checkScanRowType(typ reflect.Type) error {
 	if typ.Kind() != reflect.Ptr {
 		return errors.New(`must pass a pointer, not a value`)
 	} else {
-		if typ.Elem().Kind() != reflect.Struct {
-			return errors.New(`the param must a struct or struct pointer`)
+		if typ.Elem().Kind() != reflect.Struct && !isScalarType(typ.Elem()) {
+			return errors.New(`the param must a struct, struct pointer or scalar`)
 		} else {
 			return nil
 		}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+)
+
+/// the error type, the each callback must return it
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+/// the cursor to iterate the result set row by row without loading all the rows,
+/// the cursor must be closed after use to release the connection
+type Cursor struct {
+	rows    *sql.Rows    // the result set
+	columns []string     // the columns of the result set
+	kinds   []columnKind // the kinds of the columns, use for the map dest
+	rm      *resultMap   // the result map of the sql, nil for the db tag
+	maxRows int          // the max rows to read, 0 for no limit
+	count   int          // the count of the rows read
+	err     error        // the error got when iterating
+	exe     *execution   // the query in progress, done when the cursor closed
+}
+
+/// prepare the next row to scan
+/// @return bool: false if there is no more row or got error, see Err
+func (c *Cursor) Next() bool {
+	if c.err != nil || !c.rows.Next() {
+		return false
+	}
+	c.count++
+	c.err = checkMaxRows(c.count, c.maxRows)
+	return c.err == nil
+}
+
+/// set the current row to the dest
+/// @param dest: *struct, *scalar, map[string]interface{} or *map[string]interface{},
+/// the nested mapping of the result map is not collapsed when iterating
+func (c *Cursor) Scan(dest interface{}) error {
+	columns, err := c.Columns()
+	if err != nil {
+		return err
+	}
+
+	if m, ok := dest.(*map[string]interface{}); ok {
+		if *m == nil {
+			*m = map[string]interface{}{}
+		}
+		return c.scanMap(*m)
+	}
+	if m, ok := dest.(map[string]interface{}); ok {
+		return c.scanMap(m)
+	}
+
+	val := reflect.ValueOf(dest)
+	err = checkScanRowType(val.Type())
+	if err != nil {
+		return err
+	}
+	direct := reflect.Indirect(val)
+	if isScalarType(direct.Type()) {
+		if len(columns) != 1 {
+			return ERR_NOT_ONE_COLUMN
+		}
+		return c.rows.Scan(dest)
+	}
+	fields, err := makeReflectRow(direct, columns, c.rm)
+	if err != nil {
+		return err
+	}
+	return c.rows.Scan(fields...)
+}
+
+/// set the current row to the map, the column as the key and the value converted
+/// by the column type as the value, the NULL is converted to nil
+func (c *Cursor) scanMap(m map[string]interface{}) error {
+	if c.kinds == nil {
+		types, err := c.rows.ColumnTypes()
+		if err != nil {
+			return err
+		}
+		c.kinds = columnKinds(types)
+	}
+	values, err := scanTypedRow(c.rows, c.kinds)
+	if err != nil {
+		return err
+	}
+	for i, col := range c.columns {
+		m[col] = values[i]
+	}
+	return nil
+}
+
+/// get the columns of the result set
+func (c *Cursor) Columns() ([]string, error) {
+	if c.columns == nil {
+		columns, err := c.rows.Columns()
+		if err != nil {
+			return nil, err
+		}
+		c.columns = columns
+	}
+	return c.columns, nil
+}
+
+/// get the error got when iterating
+func (c *Cursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.rows.Err()
+}
+
+/// close the cursor and release the connection
+func (c *Cursor) Close() error {
+	err := c.rows.Close()
+	c.exe.done(c.count, c.Err())
+	return err
+}
+
+/// query rows and return the cursor
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param f: the execute func like eg: db.QueryContext/tx.QueryContext
+func (s *SqlEngine) iterate(ctx context.Context, key string, param interface{}, f queryFunc) (*Cursor, error) {
+	mapper, err := s.getSqlTemplate(key)
+	if err != nil {
+		return nil, err
+	}
+	rows, exe, err := s.queryRows(ctx, mapper, param, f)
+	if err != nil {
+		return nil, err
+	}
+	cursor := &Cursor{
+		rows:    rows,
+		rm:      mapper.resultMap,
+		maxRows: mapper.attrs.maxRows,
+		exe:     exe,
+	}
+	return cursor, nil
+}
+
+/// query rows and call the fn with every row until the fn return error
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param fn: the callback like func(row *T) error, T is the struct, scalar or map[string]interface{}
+/// @param f: the execute func like eg: db.QueryContext/tx.QueryContext
+func (s *SqlEngine) each(ctx context.Context, key string, param interface{}, fn interface{}, f queryFunc) error {
+	fv := reflect.ValueOf(fn)
+	if !fv.IsValid() || fv.Kind() != reflect.Func || fv.IsNil() {
+		return errors.New("the each callback must be a not nil func(row *T) error")
+	}
+	ft := fv.Type()
+	if ft.NumIn() != 1 || ft.NumOut() != 1 || ft.In(0).Kind() != reflect.Ptr || ft.Out(0) != errorType {
+		return errors.New("the each callback must be like func(row *T) error")
+	}
+
+	cursor, err := s.iterate(ctx, key, param, f)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	for cursor.Next() {
+		vp := reflect.New(ft.In(0).Elem())
+		err = cursor.Scan(vp.Interface())
+		if err != nil {
+			return err
+		}
+		out := fv.Call([]reflect.Value{vp})
+		if !out[0].IsNil() {
+			return out[0].Interface().(error)
+		}
+	}
+	return cursor.Err()
+}
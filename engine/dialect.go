@@ -0,0 +1,156 @@
+package engine
+
+import "strconv"
+
+/// the dialect that render the sql for a kind of database
+type Dialect interface {
+	/// the dialect name, eg: mysql,postgres
+	Name() string
+	/// the placeholder of the bound param in sql
+	/// @param index: the bound param index, start from 1
+	Placeholder(index int) string
+}
+
+/// the optional interface of the dialect that render the savepoint sql,
+/// the standard SAVEPOINT sql is used if the dialect not implement it
+type SavepointDialect interface {
+	/// the sql to create the savepoint
+	SavepointSQL(name string) string
+	/// the sql to rollback to the savepoint
+	RollbackToSavepointSQL(name string) string
+	/// the sql to release the savepoint, empty if the database not support it
+	ReleaseSavepointSQL(name string) string
+}
+
+/// the standard savepoint sql of mysql, postgres and sqlite
+type standardSavepoint struct{}
+
+/// get the sql SAVEPOINT name
+func (standardSavepoint) SavepointSQL(name string) string {
+	return "SAVEPOINT " + name
+}
+
+/// get the sql ROLLBACK TO SAVEPOINT name
+func (standardSavepoint) RollbackToSavepointSQL(name string) string {
+	return "ROLLBACK TO SAVEPOINT " + name
+}
+
+/// get the sql RELEASE SAVEPOINT name
+func (standardSavepoint) ReleaseSavepointSQL(name string) string {
+	return "RELEASE SAVEPOINT " + name
+}
+
+/// the dialect use ? as placeholder
+type questionDialect string
+
+/// get the dialect name
+func (d questionDialect) Name() string {
+	return string(d)
+}
+
+/// get the placeholder ?
+func (d questionDialect) Placeholder(index int) string {
+	return "?"
+}
+
+/// get the standard sql to create the savepoint
+func (d questionDialect) SavepointSQL(name string) string {
+	return standardSavepoint{}.SavepointSQL(name)
+}
+
+/// get the standard sql to rollback to the savepoint
+func (d questionDialect) RollbackToSavepointSQL(name string) string {
+	return standardSavepoint{}.RollbackToSavepointSQL(name)
+}
+
+/// get the standard sql to release the savepoint
+func (d questionDialect) ReleaseSavepointSQL(name string) string {
+	return standardSavepoint{}.ReleaseSavepointSQL(name)
+}
+
+/// the dialect use prefix + index as placeholder, eg: $1,:1,@p1
+type indexDialect struct {
+	standardSavepoint
+	name   string
+	prefix string
+}
+
+/// get the dialect name
+func (d indexDialect) Name() string {
+	return d.name
+}
+
+/// get the placeholder like $1
+func (d indexDialect) Placeholder(index int) string {
+	return d.prefix + strconv.Itoa(index)
+}
+
+/// the oracle dialect, it not support to release the savepoint
+type oracleDialect struct {
+	indexDialect
+}
+
+/// get the empty sql, the savepoint is released when the transaction end
+func (d oracleDialect) ReleaseSavepointSQL(name string) string {
+	return ""
+}
+
+/// the sqlserver dialect, it use SAVE TRANSACTION as the savepoint
+type sqlServerDialect struct {
+	indexDialect
+}
+
+/// get the sql SAVE TRANSACTION name
+func (d sqlServerDialect) SavepointSQL(name string) string {
+	return "SAVE TRANSACTION " + name
+}
+
+/// get the sql ROLLBACK TRANSACTION name
+func (d sqlServerDialect) RollbackToSavepointSQL(name string) string {
+	return "ROLLBACK TRANSACTION " + name
+}
+
+/// get the empty sql, the savepoint is released when the transaction end
+func (d sqlServerDialect) ReleaseSavepointSQL(name string) string {
+	return ""
+}
+
+/// the build in dialects
+var (
+	MySQL     Dialect = questionDialect("mysql")
+	SQLite    Dialect = questionDialect("sqlite")
+	Postgres  Dialect = indexDialect{name: "postgres", prefix: "$"}
+	Oracle    Dialect = oracleDialect{indexDialect{name: "oracle", prefix: ":"}}
+	SQLServer Dialect = sqlServerDialect{indexDialect{name: "sqlserver", prefix: "@p"}}
+)
+
+/// the dialect of the driver name
+var dialects = map[string]Dialect{
+	"mysql":     MySQL,
+	"sqlite":    SQLite,
+	"sqlite3":   SQLite,
+	"postgres":  Postgres,
+	"pgx":       Postgres,
+	"oracle":    Oracle,
+	"godror":    Oracle,
+	"oci8":      Oracle,
+	"sqlserver": SQLServer,
+	"mssql":     SQLServer,
+}
+
+/// register the dialect for a driver name
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param d: the dialect of the driver
+func RegisterDialect(driver string, d Dialect) {
+	dialects[driver] = d
+}
+
+/// get the dialect of the driver, the driver not registered will use the mysql dialect
+/// @param driver: db drive name, eg: mysql,sqlite
+func DialectFor(driver string) Dialect {
+	d := dialects[driver]
+	if d == nil {
+		return MySQL
+	}
+	return d
+}
@@ -0,0 +1,451 @@
+package engine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/beevik/etree"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/// the mark written into the sql template by the dynamic elements and the params,
+/// the mark will be replaced after the template execute, eg: \x01T0\x02 ... \x01/\x02,
+/// the begin of the mark is followed by a random nonce of the sql, eg: \x019f86d081884c7d65T0\x02
+const (
+	markBegin = "\x01"
+	markEnd   = "\x02"
+	markTrim  = "T"
+	markError = "E"
+	markClose = "/"
+	markBind  = "#" // the #{name} param, eg: \x01#name\x02
+	markRaw   = "$" // the ${name} param, eg: \x01$name\x02
+)
+
+/// the regex to check the foreach item and index name
+var identReg, _ = regexp.Compile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/// the marks of the dynamic elements in a sql
+type sqlMarks struct {
+	begin  string         // the mark begin with the random nonce, so the text the template output can't forge a mark
+	params *regexp.Regexp // the regex to match the param marks with the nonce
+	trims  []*trimSpec    // the trims of the <where>, <set> and <trim> elements
+	errors []string       // the errors of the empty <foreach> collection
+}
+
+/// create the marks of a sql with a random nonce
+func newSqlMarks() (sqlMarks, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return sqlMarks{}, err
+	}
+	begin := markBegin + hex.EncodeToString(nonce)
+	params, err := regexp.Compile(regexp.QuoteMeta(begin) + "([#$])([^\x01\x02]+)\x02")
+	if err != nil {
+		return sqlMarks{}, err
+	}
+	return sqlMarks{begin: begin, params: params}, nil
+}
+
+/// the trim of the <where>, <set> and <trim> element
+type trimSpec struct {
+	prefix          string   // the prefix to add when the content is not empty
+	suffix          string   // the suffix to add when the content is not empty
+	prefixOverrides []string // the content prefix to remove, ignore case
+	suffixOverrides []string // the content suffix to remove, ignore case
+}
+
+/// the foreach item in the compiling scope
+type foreachScope struct {
+	item     string // the item name
+	itemPath string // the item path to resolve the bound param, the key is quoted as a whole name, eg: ids.{{printf "%q" (print $__i0)}}
+}
+
+/// the compiler that compile the <sql> element to the template content
+type sqlCompiler struct {
+	sqlMarks
+	id        string                     // the sql full ID, use for the error message
+	namespace string                     // the namespace to resolve the include refid
+	fragments map[string]*mapperFragment // all the fragments, namespace + fragment ID as the key
+	includes  []string                   // the including fragments, use to check the cyclic include
+	props     map[string]string          // the properties of the including fragment
+	scopes    []*foreachScope            // the foreach items of the current element
+	foreachs  int                        // the foreach count, use to name the template variables
+}
+
+/// compile the children of the element to the template content
+/// @param e: the <sql> element or the dynamic element
+func (c *sqlCompiler) compile(e *etree.Element) (string, error) {
+	buf := &strings.Builder{}
+	err := c.compileChildren(e, buf)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+/// compile the children of the element and write to buf
+func (c *sqlCompiler) compileChildren(e *etree.Element, buf *strings.Builder) error {
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			buf.WriteString(c.rewriteParams(c.replaceProps(v.Data)))
+		case *etree.Element:
+			err := c.compileElement(v, buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/// compile the dynamic element and write to buf
+func (c *sqlCompiler) compileElement(e *etree.Element, buf *strings.Builder) error {
+	switch e.Tag {
+	case "if":
+		test, err := c.requireAttr(e, "test")
+		if err != nil {
+			return err
+		}
+		buf.WriteString("{{if " + test + "}}")
+		err = c.compileChildren(e, buf)
+		buf.WriteString("{{end}}")
+		return err
+	case "choose":
+		return c.compileChoose(e, buf)
+	case "foreach":
+		return c.compileForeach(e, buf)
+	case "include":
+		return c.compileInclude(e, buf)
+	case "where":
+		return c.compileTrim(e, buf, &trimSpec{
+			prefix:          "WHERE",
+			prefixOverrides: []string{"AND ", "OR "},
+		})
+	case "set":
+		return c.compileTrim(e, buf, &trimSpec{
+			prefix:          "SET",
+			suffixOverrides: []string{","},
+		})
+	case "trim":
+		return c.compileTrim(e, buf, &trimSpec{
+			prefix:          e.SelectAttrValue("prefix", ""),
+			suffix:          e.SelectAttrValue("suffix", ""),
+			prefixOverrides: splitOverrides(e.SelectAttrValue("prefixOverrides", "")),
+			suffixOverrides: splitOverrides(e.SelectAttrValue("suffixOverrides", "")),
+		})
+	default:
+		return errors.New(c.id + " has unknown element <" + e.Tag + ">")
+	}
+}
+
+/// compile the <choose> element with <when> and <otherwise> to if/else if/else
+func (c *sqlCompiler) compileChoose(e *etree.Element, buf *strings.Builder) error {
+	when := 0
+	otherwise := false
+	for _, child := range e.ChildElements() {
+		switch child.Tag {
+		case "when":
+			if otherwise {
+				return errors.New(c.id + " has <when> after <otherwise>")
+			}
+			test, err := c.requireAttr(child, "test")
+			if err != nil {
+				return err
+			}
+			if when == 0 {
+				buf.WriteString("{{if " + test + "}}")
+			} else {
+				buf.WriteString("{{else if " + test + "}}")
+			}
+			when++
+		case "otherwise":
+			if when == 0 || otherwise {
+				return errors.New(c.id + " has <otherwise> without <when> or more than one <otherwise>")
+			}
+			buf.WriteString("{{else}}")
+			otherwise = true
+		default:
+			return errors.New(c.id + " has unknown element <" + child.Tag + "> in <choose>")
+		}
+		err := c.compileChildren(child, buf)
+		if err != nil {
+			return err
+		}
+	}
+	if when == 0 {
+		return errors.New(c.id + " has <choose> without <when>")
+	}
+	buf.WriteString("{{end}}")
+	return nil
+}
+
+/// compile the <foreach> element to range the collection, eg:
+/// {{if .ids}}({{$__f0 := true}}{{range $__i0, $id := .ids}}{{if $__f0}}{{$__f0 = false}}{{else}},{{end}}#{ids.{{printf "%q" (print $__i0)}}}{{end}}){{else}}EMPTY{{end}},
+/// the item is bound by the quoted key like ids."0", so the map key with dot like "y.z" is not split as the path
+func (c *sqlCompiler) compileForeach(e *etree.Element, buf *strings.Builder) error {
+	collection, err := c.requireAttr(e, "collection")
+	if err != nil {
+		return err
+	}
+	item, err := c.requireAttr(e, "item")
+	if err != nil {
+		return err
+	}
+	n := strconv.Itoa(c.foreachs)
+	c.foreachs++
+	index := e.SelectAttrValue("index", "__i"+n)
+	if !identReg.MatchString(item) || !identReg.MatchString(index) {
+		return errors.New(c.id + " has <foreach> with invalid item or index name")
+	}
+
+	expr := c.scopeExpr(collection)
+	path := c.scopePath(collection)
+	if path != "." {
+		path += "."
+	}
+	openText := c.rewriteParams(e.SelectAttrValue("open", ""))
+	closeText := c.rewriteParams(e.SelectAttrValue("close", ""))
+	flag := "$__f" + n
+
+	buf.WriteString("{{if " + expr + "}}" + openText + "{{" + flag + " := true}}")
+	buf.WriteString("{{range $" + index + ", $" + item + " := " + expr + "}}")
+	buf.WriteString("{{if " + flag + "}}{{" + flag + " = false}}{{else}}" + e.SelectAttrValue("separator", "") + "{{end}}")
+	c.scopes = append(c.scopes, &foreachScope{item: item, itemPath: path + "{{printf \"%q\" (print $" + index + ")}}"})
+	err = c.compileChildren(e, buf)
+	c.scopes = c.scopes[:len(c.scopes)-1]
+	if err != nil {
+		return err
+	}
+	buf.WriteString("{{end}}" + closeText + "{{else}}")
+
+	switch e.SelectAttrValue("empty", "error") {
+	case "error":
+		buf.WriteString(c.begin + markError + strconv.Itoa(len(c.errors)) + markEnd)
+		c.errors = append(c.errors, "the foreach collection "+collection+" of "+c.id+" is empty")
+	case "null":
+		buf.WriteString(openText + "NULL" + closeText)
+	case "skip":
+	default:
+		return errors.New(c.id + " has <foreach> with invalid empty, must be error, null or skip")
+	}
+	buf.WriteString("{{end}}")
+	return nil
+}
+
+/// compile the <include> element with the children of the <fragment> it refer to,
+/// the refid without namespace refer to the fragment in the current namespace
+func (c *sqlCompiler) compileInclude(e *etree.Element, buf *strings.Builder) error {
+	refid, err := c.requireAttr(e, "refid")
+	if err != nil {
+		return err
+	}
+	fullId := c.namespace + "." + refid
+	fragment := c.fragments[fullId]
+	if fragment == nil {
+		fullId = refid
+		fragment = c.fragments[fullId]
+	}
+	if fragment == nil {
+		return errors.New(c.id + " include the fragment " + refid + " that is not found")
+	}
+	for _, v := range c.includes {
+		if v == fullId {
+			chain := append([]string{c.id}, c.includes...)
+			return errors.New(c.id + " include the fragment cyclic: " + strings.Join(append(chain, fullId), " -> "))
+		}
+	}
+
+	props := map[string]string{}
+	for k, v := range c.props {
+		props[k] = v
+	}
+	for _, child := range e.ChildElements() {
+		if child.Tag != "property" {
+			return errors.New(c.id + " has unknown element <" + child.Tag + "> in <include>")
+		}
+		name, err := c.requireAttr(child, "name")
+		if err != nil {
+			return err
+		}
+		props[name] = c.replaceProps(child.SelectAttrValue("value", ""))
+	}
+
+	namespace, outer := c.namespace, c.props
+	c.namespace, c.props = fragment.mapper.namespace, props
+	c.includes = append(c.includes, fullId)
+	err = c.compileChildren(fragment.el, buf)
+	c.includes = c.includes[:len(c.includes)-1]
+	c.namespace, c.props = namespace, outer
+	return err
+}
+
+/// replace the ${name} with the property of the including fragment
+func (c *sqlCompiler) replaceProps(text string) string {
+	if len(c.props) == 0 {
+		return text
+	}
+	return paramReg.ReplaceAllStringFunc(text, func(m string) string {
+		sub := paramReg.FindStringSubmatch(m)
+		if v, ok := c.props[sub[2]]; ok && sub[1] == "$" {
+			return v
+		}
+		return m
+	})
+}
+
+/// rewrite the #{name} and ${name} to the param marks when compile, the marks carry the nonce,
+/// so the text the template output at execution time is never parsed as param, the item in
+/// the foreach is rewritten to the path of the collection element
+func (c *sqlCompiler) rewriteParams(text string) string {
+	return paramReg.ReplaceAllStringFunc(text, func(m string) string {
+		sub := paramReg.FindStringSubmatch(m)
+		return c.begin + sub[1] + c.scopePath(sub[2]) + markEnd
+	})
+}
+
+/// get the bound param path of the name that may start with the foreach item
+func (c *sqlCompiler) scopePath(name string) string {
+	scope, rest := c.lookupScope(name)
+	if scope == nil {
+		return name
+	}
+	return scope.itemPath + rest
+}
+
+/// get the template expression of the name that may start with the foreach item
+func (c *sqlCompiler) scopeExpr(name string) string {
+	scope, rest := c.lookupScope(name)
+	if scope != nil {
+		return "$" + scope.item + rest
+	}
+	if name == "." {
+		return name
+	}
+	return "." + name
+}
+
+/// find the foreach scope that the name start with its item
+/// @return *foreachScope: the scope, nil if not found
+/// @return string: the rest of the name after the item, eg: .name
+func (c *sqlCompiler) lookupScope(name string) (*foreachScope, string) {
+	first, rest := name, ""
+	if i := strings.Index(name, "."); i > 0 {
+		first, rest = name[:i], name[i:]
+	}
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if c.scopes[i].item == first {
+			return c.scopes[i], rest
+		}
+	}
+	return nil, ""
+}
+
+/// compile the element to the content wrapped by the trim mark
+func (c *sqlCompiler) compileTrim(e *etree.Element, buf *strings.Builder, spec *trimSpec) error {
+	index := len(c.trims)
+	c.trims = append(c.trims, spec)
+	buf.WriteString(c.begin + markTrim + strconv.Itoa(index) + markEnd)
+	err := c.compileChildren(e, buf)
+	buf.WriteString(c.begin + markClose + markEnd)
+	return err
+}
+
+/// get the attribute value that must not be empty
+func (c *sqlCompiler) requireAttr(e *etree.Element, key string) (string, error) {
+	val := strings.TrimSpace(e.SelectAttrValue(key, ""))
+	if val == "" {
+		return "", errors.New(c.id + " has <" + e.Tag + "> without " + key)
+	}
+	return val, nil
+}
+
+/// split the overrides attribute like "AND |OR "
+func splitOverrides(val string) []string {
+	if val == "" {
+		return nil
+	}
+	return strings.Split(val, "|")
+}
+
+/// replace the marks in the executed sql with the result of the dynamic elements
+/// @param sqlStr: the sql that the template executed
+func (m *sqlMarks) apply(sqlStr string) (string, error) {
+	if !strings.Contains(sqlStr, m.begin) {
+		return sqlStr, nil
+	}
+
+	stack := []*strings.Builder{{}}
+	specs := []*trimSpec{nil}
+	for {
+		i := strings.Index(sqlStr, m.begin)
+		if i < 0 {
+			stack[len(stack)-1].WriteString(sqlStr)
+			break
+		}
+		stack[len(stack)-1].WriteString(sqlStr[:i])
+		j := strings.Index(sqlStr[i:], markEnd)
+		if j < 0 {
+			return "", errors.New("the sql mark is not closed")
+		}
+		mark := sqlStr[i+len(m.begin) : i+j]
+		sqlStr = sqlStr[i+j+len(markEnd):]
+
+		switch {
+		case mark == markClose:
+			if len(stack) < 2 {
+				return "", errors.New("the sql mark is not opened")
+			}
+			content := specs[len(specs)-1].apply(stack[len(stack)-1].String())
+			stack = stack[:len(stack)-1]
+			specs = specs[:len(specs)-1]
+			stack[len(stack)-1].WriteString(content)
+		case strings.HasPrefix(mark, markTrim):
+			index, err := strconv.Atoi(mark[len(markTrim):])
+			if err != nil || index < 0 || index >= len(m.trims) {
+				return "", errors.New("the sql mark is invalid: " + mark)
+			}
+			stack = append(stack, &strings.Builder{})
+			specs = append(specs, m.trims[index])
+		case strings.HasPrefix(mark, markBind), strings.HasPrefix(mark, markRaw):
+			// keep the param mark to bind after all the marks are applied
+			stack[len(stack)-1].WriteString(m.begin + mark + markEnd)
+		case strings.HasPrefix(mark, markError):
+			index, err := strconv.Atoi(mark[len(markError):])
+			if err != nil || index < 0 || index >= len(m.errors) {
+				return "", errors.New("the sql mark is invalid: " + mark)
+			}
+			return "", errors.New(m.errors[index])
+		default:
+			return "", errors.New("the sql mark is invalid: " + mark)
+		}
+	}
+	if len(stack) != 1 {
+		return "", errors.New("the sql mark is not closed")
+	}
+	return stack[0].String(), nil
+}
+
+/// trim the content, return empty if the content is empty after trim
+func (t *trimSpec) apply(content string) string {
+	content = strings.TrimSpace(content)
+	for _, o := range t.prefixOverrides {
+		if o != "" && len(content) >= len(o) && strings.EqualFold(content[:len(o)], o) {
+			content = strings.TrimSpace(content[len(o):])
+			break
+		}
+	}
+	for _, o := range t.suffixOverrides {
+		if o != "" && len(content) >= len(o) && strings.EqualFold(content[len(content)-len(o):], o) {
+			content = strings.TrimSpace(content[:len(content)-len(o)])
+			break
+		}
+	}
+	if content == "" {
+		return ""
+	}
+	return " " + t.prefix + " " + content + " " + t.suffix + " "
+}
@@ -1,26 +1,61 @@
 package engine
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"github.com/beevik/etree"
 	"github.com/zhaobingss/sqlmap/log"
 	"github.com/zhaobingss/sqlmap/util"
+	"io"
+	"io/fs"
 	"io/ioutil"
-	"strings"
+	"os"
+	"sort"
 	"sync"
+	"time"
 )
 
 /// the SqlEngine
 type SqlEngine struct {
-	lock sync.RWMutex
-	db   *sql.DB
-	init bool
+	lock          sync.RWMutex
+	db            *sql.DB
+	init          bool
+	namespace     string                  // the namespace of the *.goxml file not declare namespace
+	sqlMap        map[string]*SqlTemplate // cache sql template, namespace + sql ID as the key
+	tplBuilder    TemplateBuilder         // the template builder to build the sql template
+	dialect       Dialect                 // the dialect to render the placeholder
+	sqlDir        string                  // the *.goxml files dir, use for reload
+	mappers       map[string]*mapperFile  // the parsed *.goxml files, file path as the key
+	fileStats     map[string]fileStat     // the state of the loaded *.goxml files, file path as the key
+	failStats     map[string]fileStat     // the state of the *.goxml files fail to reload last time
+	failErr       error                   // the error of the last reload fail
+	reloadLock    sync.Mutex              // the lock of reload and watch
+	watcher       *sqlWatcher             // the watcher to reload the changed *.goxml files
+	cache         Cache                   // the cache of the query results
+	interceptors  []Interceptor           // the interceptors around the statement execution
+	logger        log.Logger              // the logger of the sql execution and the engine events
+	slowThreshold time.Duration           // the threshold of the slow sql logged at WARN level
+	metrics       *metrics                // the metrics of the statements
+	tracer        Tracer                  // the tracer of the statement execution and the transaction
+	sqlComment    bool                    // append the comment with the sql key and the trace ID to the sql
+	replicas      *replicaPool            // the replicas that serve the queries outside the transaction
+}
+
+/// the first init engine, the session init by the deprecated Session.Init execute its sql map
+var defaultEngine struct {
+	lock   sync.Mutex
+	engine *SqlEngine
 }
 
 /// create a new engine without init
 func New() *SqlEngine {
-	engine := &SqlEngine{}
+	engine := &SqlEngine{
+		namespace: DefaultNamespace,
+		sqlMap:    map[string]*SqlTemplate{},
+		cache:     NewLRUCache(DefaultCacheSize),
+		metrics:   newMetrics(DefaultBuckets),
+		replicas:  &replicaPool{},
+	}
 	return engine
 }
 
@@ -34,6 +69,38 @@ func NewEngine(driver, dataSrcName, sqlDir string) (*SqlEngine, error) {
 	return engine, err
 }
 
+/// create a new engine with init from the fs, eg: embed.FS
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param fsys: the fs that contains the *.goxml files
+/// @param sqlDir: the *.goxml files dir in the fs, "." for the root
+func NewEngineFS(driver, dataSrcName string, fsys fs.FS, sqlDir string) (*SqlEngine, error) {
+	engine := New()
+	err := engine.InitFS(driver, dataSrcName, fsys, sqlDir)
+	return engine, err
+}
+
+/// create a new engine with init from the reader
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param name: the name of the *.goxml content, use for the error message
+/// @param r: the reader of the *.goxml content
+func NewEngineReader(driver, dataSrcName, name string, r io.Reader) (*SqlEngine, error) {
+	engine := New()
+	err := engine.InitReader(driver, dataSrcName, name, r)
+	return engine, err
+}
+
+/// create a new engine with init from the *.goxml contents
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param files: the *.goxml contents, the file name as the key
+func NewEngineBytes(driver, dataSrcName string, files map[string][]byte) (*SqlEngine, error) {
+	engine := New()
+	err := engine.InitBytes(driver, dataSrcName, files)
+	return engine, err
+}
+
 /// get the database/sql.DB
 func (s *SqlEngine) GetDB() *sql.DB {
 	s.checkInit()
@@ -45,6 +112,52 @@ func (s *SqlEngine) GetDB() *sql.DB {
 /// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
 /// @param sqlDir: the sql.goxml files dir
 func (s *SqlEngine) Init(driver, dataSrcName, sqlDir string) error {
+	return s.initWith(driver, dataSrcName, func() error {
+		return s.initSql(sqlDir)
+	})
+}
+
+/// init the sql engine from the fs, eg: embed.FS
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param fsys: the fs that contains the *.goxml files
+/// @param sqlDir: the *.goxml files dir in the fs, "." for the root
+func (s *SqlEngine) InitFS(driver, dataSrcName string, fsys fs.FS, sqlDir string) error {
+	return s.initWith(driver, dataSrcName, func() error {
+		return s.initSqlFS(fsys, sqlDir)
+	})
+}
+
+/// init the sql engine from the reader
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param name: the name of the *.goxml content, use for the error message
+/// @param r: the reader of the *.goxml content
+func (s *SqlEngine) InitReader(driver, dataSrcName, name string, r io.Reader) error {
+	return s.initWith(driver, dataSrcName, func() error {
+		bts, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return s.initSqlBytes(map[string][]byte{name: bts})
+	})
+}
+
+/// init the sql engine from the *.goxml contents
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param files: the *.goxml contents, the file name as the key
+func (s *SqlEngine) InitBytes(driver, dataSrcName string, files map[string][]byte) error {
+	return s.initWith(driver, dataSrcName, func() error {
+		return s.initSqlBytes(files)
+	})
+}
+
+/// open the db and init the sql engine with the load func
+/// @param driver: db drive name, eg: mysql,sqlite
+/// @param dataSrcName: eg: root:root@(127.0.0.1:3306)/test
+/// @param load: the func to load the *.goxml files
+func (s *SqlEngine) initWith(driver, dataSrcName string, load func() error) error {
 	if s.init {
 		return errors.New("the engine is already init")
 	}
@@ -56,25 +169,102 @@ func (s *SqlEngine) Init(driver, dataSrcName, sqlDir string) error {
 	if err != nil {
 		return err
 	}
-	err = s.initSql(sqlDir)
-	tplBuilder = &DefaultTemplate{}
-	return err
+	defaultEngine.lock.Lock()
+	if defaultEngine.engine == nil {
+		defaultEngine.engine = s
+	}
+	defaultEngine.lock.Unlock()
+	if s.tplBuilder == nil {
+		s.tplBuilder = &DefaultTemplate{}
+	}
+	if s.dialect == nil {
+		s.dialect = DialectFor(driver)
+	}
+	return load()
 }
 
 /// execute the sql with a can ignore result
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
 func (s *SqlEngine) Execute(key string, param interface{}) (sql.Result, error) {
+	return s.ExecuteContext(context.Background(), key, param)
+}
+
+/// execute the sql with a can ignore result
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) ExecuteContext(ctx context.Context, key string, param interface{}) (sql.Result, error) {
 	s.checkInit()
-	return exec(key, param, s.db.Exec)
+	return s.exec(ctx, key, param, s.execContext(ctx))
 }
 
 /// execute the sql and set result to []map[string]string
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
 func (s *SqlEngine) Query(key string, param interface{}) ([]map[string]string, error) {
+	return s.QueryContext(context.Background(), key, param)
+}
+
+/// execute the sql and set result to []map[string]string
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryContext(ctx context.Context, key string, param interface{}) ([]map[string]string, error) {
+	s.checkInit()
+	return s.query(ctx, key, param, s.queryContext(ctx))
+}
+
+/// execute the sql and set result to []map[string]interface{}, the value is converted
+/// by the column type to int64, float64, bool, time.Time, []byte or string, the NULL is nil
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryMaps(key string, param interface{}) ([]map[string]interface{}, error) {
+	return s.QueryMapsContext(context.Background(), key, param)
+}
+
+/// execute the sql and set result to []map[string]interface{}, the value is converted
+/// by the column type to int64, float64, bool, time.Time, []byte or string, the NULL is nil
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryMapsContext(ctx context.Context, key string, param interface{}) ([]map[string]interface{}, error) {
+	s.checkInit()
+	return s.queryMaps(ctx, key, param, s.queryContext(ctx))
+}
+
+/// execute the sql and set result to []map[string][]byte, the NULL is nil
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryBytes(key string, param interface{}) ([]map[string][]byte, error) {
+	return s.QueryBytesContext(context.Background(), key, param)
+}
+
+/// execute the sql and set result to []map[string][]byte, the NULL is nil
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryBytesContext(ctx context.Context, key string, param interface{}) ([]map[string][]byte, error) {
+	s.checkInit()
+	return s.queryBytes(ctx, key, param, s.queryContext(ctx))
+}
+
+/// execute the sql and return the columns and the rows in the column order,
+/// the value is converted like QueryMaps
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryRows(key string, param interface{}) ([]string, [][]interface{}, error) {
+	return s.QueryRowsContext(context.Background(), key, param)
+}
+
+/// execute the sql and return the columns and the rows in the column order,
+/// the value is converted like QueryMaps
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) QueryRowsContext(ctx context.Context, key string, param interface{}) ([]string, [][]interface{}, error) {
 	s.checkInit()
-	return query(key, param, s.db.Query)
+	return s.querySlice(ctx, key, param, s.queryContext(ctx))
 }
 
 /// execute sql and set the result to a slice dest
@@ -82,8 +272,17 @@ func (s *SqlEngine) Query(key string, param interface{}) ([]map[string]string, e
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
 func (s *SqlEngine) Select(dest interface{}, key string, param interface{}) error {
+	return s.SelectContext(context.Background(), dest, key, param)
+}
+
+/// execute sql and set the result to a slice dest
+/// @param ctx: the context of the execution
+/// @param the result will be set to dest, and the dest must be like eg: *[]*struct or *[]struct
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) SelectContext(ctx context.Context, dest interface{}, key string, param interface{}) error {
 	s.checkInit()
-	return selectRows(dest, key, param, s.db.Query)
+	return s.selectRows(ctx, dest, key, param, s.queryContext(ctx))
 }
 
 /// execute sql and set the result to a struct dest
@@ -94,40 +293,155 @@ func (s *SqlEngine) Select(dest interface{}, key string, param interface{}) erro
 /// ERR_NOT_GOT_RECORD indicate that not got any recode from the database
 /// ERR_MORE_THAN_ONE_RECORD indicate that got more than one record from database
 func (s *SqlEngine) SelectOne(dest interface{}, key string, param interface{}) error {
+	return s.SelectOneContext(context.Background(), dest, key, param)
+}
+
+/// execute sql and set the result to a struct dest
+/// @param ctx: the context of the execution
+/// @param the result will be set to dest, and the dest must be like eg: *struct
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @return error: ERR_NOT_GOT_RECORD,ERR_MORE_THAN_ONE_RECORD,...
+func (s *SqlEngine) SelectOneContext(ctx context.Context, dest interface{}, key string, param interface{}) error {
+	s.checkInit()
+	return s.selectRow(ctx, dest, key, param, s.queryContext(ctx))
+}
+
+/// execute sql and return the cursor to iterate the result set row by row,
+/// the cursor must be closed after use
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) Iterate(key string, param interface{}) (*Cursor, error) {
+	return s.IterateContext(context.Background(), key, param)
+}
+
+/// execute sql and return the cursor to iterate the result set row by row,
+/// the cursor must be closed after use
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *SqlEngine) IterateContext(ctx context.Context, key string, param interface{}) (*Cursor, error) {
 	s.checkInit()
-	return selectRow(dest, key, param, s.db.Query)
+	return s.iterate(ctx, key, param, s.queryContext(ctx))
+}
+
+/// execute sql and call the fn with every row, stop when the fn return error
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param fn: the callback like func(row *T) error, T is the struct, scalar or map[string]interface{}
+func (s *SqlEngine) Each(key string, param interface{}, fn interface{}) error {
+	return s.EachContext(context.Background(), key, param, fn)
+}
+
+/// execute sql and call the fn with every row, stop when the fn return error
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param fn: the callback like func(row *T) error, T is the struct, scalar or map[string]interface{}
+func (s *SqlEngine) EachContext(ctx context.Context, key string, param interface{}, fn interface{}) error {
+	s.checkInit()
+	return s.each(ctx, key, param, fn, s.queryContext(ctx))
 }
 
 /// start transaction with the given function f
 /// @param f：the function that the transaction code will be run
-func (s *SqlEngine) Transaction(f func(s *Session)(interface{}, error)) (interface{}, error) {
-	session := newSession(s.db)
-	err := session.BeginTx()
-	if err != nil {
-		return nil, err
+func (s *SqlEngine) Transaction(f func(s *Session) (interface{}, error)) (interface{}, error) {
+	return s.TransactionTx(context.Background(), nil, f)
+}
+
+/// start transaction with the given function f, the ctx passed to f carry the session of the transaction,
+/// and the context-aware methods of the engine called with it execute in the transaction,
+/// it joins the transaction if the ctx already carry one of the engine
+/// @param ctx: the context of the transaction
+/// @param f：the function that the transaction code will be run
+func (s *SqlEngine) TransactionContext(ctx context.Context, f func(ctx context.Context) error) error {
+	_, err := s.TransactionTx(ctx, nil, func(session *Session) (interface{}, error) {
+		return nil, f(session.context(ctx))
+	})
+	return err
+}
+
+/// start transaction with the given function f, the transaction is rollback if f return error or panic,
+/// the panic is raised again after the rollback, it joins the transaction if the ctx already carry one of the engine
+/// @param ctx: the context of the transaction
+/// @param opts: the transaction options like the isolation level and read-only, nil for the default
+/// @param f：the function that the transaction code will be run
+/// @return error: the error of f, or *RollbackError if the rollback also fail
+func (s *SqlEngine) TransactionTx(ctx context.Context, opts *sql.TxOptions, f func(s *Session) (interface{}, error)) (interface{}, error) {
+	session := s.ambientSession(ctx)
+	if session == nil {
+		session = newSession(s)
 	}
-	result, err := f(session)
-	if err != nil {
-		return nil, err
+	return session.TransactionTx(ctx, opts, PropagationRequired, f)
+}
+
+/// get the session in the transaction of the engine carried by the ctx, nil if there is not
+/// @param ctx: the context of the execution
+func (s *SqlEngine) ambientSession(ctx context.Context) *Session {
+	session := txSession(ctx)
+	if session == nil || session.engine != s {
+		return nil
 	}
+	return session
+}
 
-	err = session.Commit()
-	if err != nil {
-		return nil, err
+/// get the query func of the transaction carried by the ctx, or the replicas or the db if there is not
+/// @param ctx: the context of the execution
+func (s *SqlEngine) queryContext(ctx context.Context) queryFunc {
+	if session := s.ambientSession(ctx); session != nil {
+		return session.tx.QueryContext
 	}
-	return result, err
+	if !s.replicas.empty() {
+		return s.readQuery
+	}
+	return s.db.QueryContext
+}
+
+/// get the exec func of the transaction carried by the ctx, or the db if there is not
+/// @param ctx: the context of the execution
+func (s *SqlEngine) execContext(ctx context.Context) execFunc {
+	if session := s.ambientSession(ctx); session != nil {
+		return session.tx.ExecContext
+	}
+	return s.db.ExecContext
 }
 
 /// get a session use for transaction
 func (s *SqlEngine) NewSession() *Session {
 	s.checkInit()
-	return newSession(s.db)
+	return newSession(s)
 }
 
 /// register a sql template to replace the default, default use go text/template
 /// @param tb: the template builder
 func (s *SqlEngine) RegisterTemplate(tb TemplateBuilder) {
-	tplBuilder = tb
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tplBuilder = tb
+	for _, v := range s.sqlMap {
+		v.tpl = nil
+	}
+}
+
+/// set the dialect to replace the one chosen by the driver name
+/// @param d: the dialect
+func (s *SqlEngine) SetDialect(d Dialect) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.dialect = d
+}
+
+/// get the dialect of the engine
+func (s *SqlEngine) Dialect() Dialect {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.dialect
+}
+
+/// set the namespace of the *.goxml file that not declare namespace, must be call before init
+/// @param namespace: the default namespace
+func (s *SqlEngine) SetDefaultNamespace(namespace string) {
+	s.namespace = namespace
 }
 
 /// register the log func
@@ -145,35 +459,104 @@ func (s *SqlEngine) initSql(sqlDir string) error {
 		return err
 	}
 
+	stats := make(map[string]fileStat, len(files))
+	mappers := make([]*mapperFile, 0, len(files))
 	for _, f := range files {
-		err = s.initSqlMap(f)
+		fi, err := os.Stat(f)
 		if err != nil {
 			return err
 		}
+		stats[f] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+		m, err := s.readMapperFile(f)
+		if err != nil {
+			return err
+		}
+		mappers = append(mappers, m)
 	}
 
+	err = s.initSqlMap(mappers)
+	if err != nil {
+		return err
+	}
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.sqlDir = sqlDir
+	s.setMapperFiles(mappers, stats)
 	return nil
 }
 
-/// load the *goxml file content to map
+/// init the *.goxml files of the fs to map
+/// @param fsys: the fs that contains the *.goxml files
+/// @param sqlDir: the *.goxml files dir in the fs
+func (s *SqlEngine) initSqlFS(fsys fs.FS, sqlDir string) error {
+	mappers := make([]*mapperFile, 0)
+	err := fs.WalkDir(fsys, sqlDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		bts, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+		m, err := s.parse(file, bts)
+		if err != nil {
+			return err
+		}
+		mappers = append(mappers, m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.initSqlMap(mappers)
+}
+
+/// init the *.goxml contents to map
+/// @param files: the *.goxml contents, the file name as the key
+func (s *SqlEngine) initSqlBytes(files map[string][]byte) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mappers := make([]*mapperFile, 0, len(files))
+	for _, name := range names {
+		m, err := s.parse(name, files[name])
+		if err != nil {
+			return err
+		}
+		mappers = append(mappers, m)
+	}
+	return s.initSqlMap(mappers)
+}
+
+/// read and parse the *goxml file
 /// @param file: the *.goxml file path
-func (s *SqlEngine) initSqlMap(file string) error {
+func (s *SqlEngine) readMapperFile(file string) (*mapperFile, error) {
 	bts, err := ioutil.ReadFile(file)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return s.parse(file, bts)
+}
 
-	m, err := s.parse(bts)
+/// compile the *goxml files content to map
+/// @param mappers: the parsed *.goxml files
+func (s *SqlEngine) initSqlMap(mappers []*mapperFile) error {
+	m, err := compileMapperFiles(mappers)
 	if err != nil {
 		return err
 	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if m != nil && len(m) > 0 {
 		for k, v := range m {
-			vv := sqlMap[k]
+			vv := s.sqlMap[k]
 			if vv != nil {
 				return errors.New("the *.goxml map key is repeat: " + k)
 			} else {
-				sqlMap[k] = &SqlTemplate{sql: v}
+				s.sqlMap[k] = v
 			}
 		}
 	}
@@ -181,50 +564,6 @@ func (s *SqlEngine) initSqlMap(file string) error {
 	return nil
 }
 
-/// parse the *.goxml file
-func (s *SqlEngine) parse(xml []byte) (map[string]string, error) {
-	ret := map[string]string{}
-
-	doc := etree.NewDocument()
-	err := doc.ReadFromBytes(xml)
-	if err != nil {
-		return ret, err
-	}
-
-	sm := doc.SelectElement("sqlmap")
-	if sm == nil {
-		return nil, errors.New("the sqlmap element is not found")
-	}
-
-	namespace := sm.SelectAttrValue("namespace", DefaultNamespace)
-	if namespace == "" {
-		namespace = DefaultNamespace
-	}
-
-	els := sm.SelectElements("sql")
-	if els == nil || len(els) < 1 {
-		return ret, nil
-	}
-
-	for _, e := range els {
-		id := e.SelectAttrValue("id", "")
-		if id == "" {
-			return ret, errors.New(namespace + " has sql not have ID")
-		}
-		fullId := namespace + "." + id
-		if ret[fullId] == fullId {
-			return ret, errors.New(namespace + "." + fullId + " repeat")
-		}
-		val := e.Text()
-		val = strings.Replace(val, "\n", " ", -1)
-		val = strings.Trim(val, "\n")
-		val = strings.TrimSpace(val)
-		ret[fullId] = val
-	}
-
-	return ret, nil
-}
-
 /// check if the engine is init
 func (s *SqlEngine) checkInit() {
 	if !s.init {
@@ -4,3 +4,36 @@ import "errors"
 
 var ERR_NOT_GOT_RECORD = errors.New("got record empty")
 var ERR_MORE_THAN_ONE_RECORD = errors.New("more than one record")
+var ERR_NOT_ONE_COLUMN = errors.New("the scalar dest must get one column")
+var ERR_TOO_MANY_ROWS = errors.New("the rows exceed the maxRows of the sql")
+var ERR_NOT_QUERY_STATEMENT = errors.New("the write sql can't be executed as a query")
+var ERR_NOT_EXEC_STATEMENT = errors.New("the select or readOnly sql can't be executed as a write")
+var ERR_NO_TX = errors.New("the transaction is not begun")
+var ERR_TX_EXISTS = errors.New("the transaction is already begun but the propagation is never")
+var ERR_ROLLBACK_ONLY = errors.New("the transaction is marked as rollback-only and has been rollback")
+
+/// the error of the transaction that fail to rollback after the error of the function
+type RollbackError struct {
+	Err         error // the error that cause the rollback
+	RollbackErr error // the error of the rollback
+}
+
+/// get the message of the both errors
+func (e *RollbackError) Error() string {
+	return e.Err.Error() + "; rollback fail: " + e.RollbackErr.Error()
+}
+
+/// get the error that cause the rollback
+func (e *RollbackError) Unwrap() error {
+	return e.Err
+}
+
+/// check if the error that cause the rollback or the error of the rollback is the target
+func (e *RollbackError) Is(target error) bool {
+	return errors.Is(e.Err, target) || errors.Is(e.RollbackErr, target)
+}
+
+/// find the error that match the target in the error that cause the rollback and then the error of the rollback
+func (e *RollbackError) As(target interface{}) bool {
+	return errors.As(e.Err, target) || errors.As(e.RollbackErr, target)
+}
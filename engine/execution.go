@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"github.com/zhaobingss/sqlmap/log"
+	"time"
+)
+
+/// the query in progress, it logs the sql and the duration when the rows are consumed
+type execution struct {
+	engine *SqlEngine
+	ctx    context.Context
+	inv    *Invocation
+	start  time.Time
+	cancel context.CancelFunc
+	closed bool
+}
+
+/// close the rows, release the timeout of the sql and log the execution
+/// @param count: the count of the rows returned
+/// @param err: the error got when reading the rows
+func (e *execution) done(count int, err error) {
+	if e.closed {
+		return
+	}
+	e.closed = true
+	if e.inv.Rows != nil {
+		e.inv.Rows.Close()
+	}
+	e.cancel()
+	e.engine.observe(e.ctx, e.inv, time.Since(e.start), "rows", int64(count), err)
+}
+
+/// set the logger of the sql execution and the engine events, the default is log.Default()
+/// @param l: the logger
+func (s *SqlEngine) SetLogger(l log.Logger) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logger = l
+}
+
+/// set the threshold of the slow sql that logged at WARN level
+/// @param d: the threshold, 0 to disable
+func (s *SqlEngine) SetSlowThreshold(d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.slowThreshold = d
+}
+
+/// get the logger of the engine
+func (s *SqlEngine) getLogger() log.Logger {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.logger == nil {
+		return log.Default()
+	}
+	return s.logger
+}
+
+/// get the threshold of the slow sql
+func (s *SqlEngine) getSlowThreshold() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.slowThreshold
+}
+
+/// end the span, record the metrics and log the sql execution,
+/// ERR_NOT_GOT_RECORD of SelectOne is observed as success, the sql is executed well
+/// @param ctx: the context of the execution
+/// @param inv: the invocation of the sql
+/// @param d: the duration of the execution
+/// @param name: the name of the count, rows or affected
+/// @param count: the count of the rows returned or affected
+/// @param err: the error of the execution
+func (s *SqlEngine) observe(ctx context.Context, inv *Invocation, d time.Duration, name string, count int64, err error) {
+	if err == ERR_NOT_GOT_RECORD {
+		err = nil
+	}
+	endSpan(inv.span, err, Attr("db."+name, count))
+	s.metrics.record(inv.Key, d, count, err)
+	s.logExecution(ctx, inv, d, log.F(name, count), err)
+}
+
+/// log the sql execution, at ERROR level if it fail, WARN level if it is slow, INFO level otherwise
+/// @param ctx: the context of the execution
+/// @param inv: the invocation of the sql
+/// @param d: the duration of the execution
+/// @param count: the field of the rows returned or affected
+/// @param err: the error of the execution
+func (s *SqlEngine) logExecution(ctx context.Context, inv *Invocation, d time.Duration, count log.Field, err error) {
+	level, msg := log.LevelInfo, "execute sql"
+	if err != nil {
+		level, msg = log.LevelError, "execute sql fail"
+	} else if threshold := s.getSlowThreshold(); threshold > 0 && d >= threshold {
+		level, msg = log.LevelWarn, "slow sql"
+	}
+	logger := s.getLogger()
+	if !logger.Enabled(level) {
+		return
+	}
+	fields := []log.Field{
+		log.F("key", inv.Key),
+		log.F("sql", inv.SQL),
+		log.F("args", inv.Args),
+		count,
+		log.F("duration", d),
+	}
+	if err != nil {
+		fields = append(fields, log.F("error", err))
+	}
+	logger.Log(ctx, level, msg, fields...)
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+)
+
+/// the interface{} type, the scan type of the in-memory rows
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+/// the operation kind of the invocation
+type Operation int
+
+const (
+	OperationQuery Operation = iota // Query, Select, SelectOne, Iterate and Each
+	OperationExec                   // Execute and Session.Exec
+)
+
+/// get the name of the operation
+func (o Operation) String() string {
+	switch o {
+	case OperationQuery:
+		return "query"
+	case OperationExec:
+		return "exec"
+	}
+	return "unknown"
+}
+
+/// the statement execution passed through the interceptors,
+/// the interceptor can modify the SQL and Args before call next,
+/// or set the Rows or Result and not call next to short-circuit
+type Invocation struct {
+	Key       string        // sql map key, namespace + sql ID
+	SQL       string        // the rendered sql to execute
+	Args      []interface{} // the args bound to the sql
+	Operation Operation     // the operation kind
+	FetchSize int           // the fetchSize hint of the query, 0 for the driver default
+	Session   *Session      // the session that execute the sql, nil for the engine
+	Tx        *sql.Tx       // the transaction that execute the sql, nil if not in transaction
+	Rows      *sql.Rows     // the result of the query, set after next return
+	Result    sql.Result    // the result of the exec, set after next return
+	span      Span          // the span of the execution, nil if the tracer is not set
+}
+
+/// set the in-memory rows as the result of the query to short-circuit
+/// @param columns: the columns of the rows
+/// @param values: the rows, the value must be nil, int64, float64, bool, []byte, string or time.Time
+func (inv *Invocation) SetRows(columns []string, values [][]interface{}) error {
+	entry := &cacheEntry{
+		columns:   columns,
+		scanTypes: make([]reflect.Type, len(columns)),
+		dbTypes:   make([]string, len(columns)),
+		values:    values,
+	}
+	for i := range entry.scanTypes {
+		entry.scanTypes[i] = interfaceType
+	}
+	rows, err := entry.rows(context.Background())
+	if err != nil {
+		return err
+	}
+	inv.Rows = rows
+	return nil
+}
+
+/// call the next interceptor or execute the sql
+type Invoker func(ctx context.Context, inv *Invocation) error
+
+/// the interceptor around the statement execution, it can observe or modify the invocation,
+/// and must call next to continue unless short-circuit
+type Interceptor interface {
+	Intercept(ctx context.Context, inv *Invocation, next Invoker) error
+}
+
+/// the func adapter of the Interceptor
+type InterceptorFunc func(ctx context.Context, inv *Invocation, next Invoker) error
+
+/// call the func
+func (f InterceptorFunc) Intercept(ctx context.Context, inv *Invocation, next Invoker) error {
+	return f(ctx, inv, next)
+}
+
+/// register the interceptor, the first registered is the outermost
+/// @param i: the interceptor
+func (s *SqlEngine) RegisterInterceptor(i Interceptor) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.interceptors = append(s.interceptors, i)
+}
+
+/// pass the invocation through the interceptors to the invoker
+/// @param ctx: the context of the execution
+/// @param inv: the invocation
+/// @param invoker: the func execute the sql at the end of the chain
+func (s *SqlEngine) intercept(ctx context.Context, inv *Invocation, invoker Invoker) error {
+	s.lock.RLock()
+	interceptors := s.interceptors
+	s.lock.RUnlock()
+	if session, ok := ctx.Value(sessionKey{}).(*Session); ok {
+		inv.Session = session
+		inv.Tx = session.tx
+	}
+
+	h := invoker
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, inv *Invocation) error {
+			return interceptor.Intercept(ctx, inv, next)
+		}
+	}
+	err := h(ctx, inv)
+	if err != nil {
+		if inv.Rows != nil {
+			inv.Rows.Close()
+		}
+		return err
+	}
+	if inv.Operation == OperationQuery && inv.Rows == nil {
+		return errors.New(inv.Key + ": the interceptor return no rows")
+	}
+	if inv.Operation == OperationExec && inv.Result == nil {
+		return errors.New(inv.Key + ": the interceptor return no result")
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"errors"
+	"github.com/beevik/etree"
+	"strings"
+)
+
+/// the parsed *.goxml file
+type mapperFile struct {
+	file       string                    // the *.goxml file path
+	namespace  string                    // the namespace of the file
+	sqls       []*etree.Element          // the <sql> elements
+	fragments  map[string]*etree.Element // the <fragment> elements, namespace + fragment ID as the key
+	resultMaps map[string]*resultMap     // the <resultMap> elements, namespace + result map ID as the key
+	attrs      statementAttrs            // the default cache attributes of the statements
+	dependsOn  []string                  // the namespaces that flush the cache of this namespace
+}
+
+/// the <fragment> element with the file that declare it
+type mapperFragment struct {
+	el     *etree.Element
+	mapper *mapperFile
+}
+
+/// parse the *.goxml file
+/// @param file: the *.goxml file path, use for the error message
+/// @param xml: the *.goxml file content
+func (s *SqlEngine) parse(file string, xml []byte) (*mapperFile, error) {
+	doc := etree.NewDocument()
+	err := doc.ReadFromBytes(xml)
+	if err != nil {
+		return nil, errors.New(file + ": " + err.Error())
+	}
+
+	sm := doc.SelectElement("sqlmap")
+	if sm == nil {
+		return nil, errors.New(file + ": the sqlmap element is not found")
+	}
+
+	namespace := sm.SelectAttrValue("namespace", s.namespace)
+	if namespace == "" {
+		namespace = s.namespace
+	}
+
+	attrs, err := parseNamespaceAttrs(sm)
+	if err != nil {
+		return nil, errors.New(file + ": " + namespace + ": " + err.Error())
+	}
+	dependsOn := make([]string, 0)
+	for _, ns := range strings.Split(sm.SelectAttrValue("dependsOn", ""), ",") {
+		ns = strings.TrimSpace(ns)
+		if ns != "" {
+			dependsOn = append(dependsOn, ns)
+		}
+	}
+
+	ret := &mapperFile{
+		file:       file,
+		namespace:  namespace,
+		sqls:       sm.SelectElements("sql"),
+		fragments:  map[string]*etree.Element{},
+		resultMaps: map[string]*resultMap{},
+		attrs:      attrs,
+		dependsOn:  dependsOn,
+	}
+	for _, e := range sm.SelectElements("fragment") {
+		id := e.SelectAttrValue("id", "")
+		if id == "" {
+			return nil, errors.New(file + ": " + namespace + " has fragment not have ID")
+		}
+		fullId := namespace + "." + id
+		if ret.fragments[fullId] != nil {
+			return nil, errors.New(file + ": the fragment " + fullId + " repeat")
+		}
+		ret.fragments[fullId] = e
+	}
+	for _, e := range sm.SelectElements("resultMap") {
+		id := e.SelectAttrValue("id", "")
+		if id == "" {
+			return nil, errors.New(file + ": " + namespace + " has resultMap not have ID")
+		}
+		fullId := namespace + "." + id
+		if ret.resultMaps[fullId] != nil {
+			return nil, errors.New(file + ": the resultMap " + fullId + " repeat")
+		}
+		rm, err := parseResultMap(namespace, fullId, e)
+		if err != nil {
+			return nil, errors.New(file + ": " + err.Error())
+		}
+		ret.resultMaps[fullId] = rm
+	}
+
+	return ret, nil
+}
+
+/// compile the <sql> elements of the *.goxml files to sql template, the result maps are copied
+/// before resolve, so the parsed files reused by reload never change the live statements
+/// @param mappers: the parsed *.goxml files
+func compileMapperFiles(mappers []*mapperFile) (map[string]*SqlTemplate, error) {
+	fragments := map[string]*mapperFragment{}
+	resultMaps := map[string]*resultMap{}
+	dependents := map[string][]string{}
+	for _, m := range mappers {
+		for _, ns := range m.dependsOn {
+			dependents[ns] = append(dependents[ns], m.namespace)
+		}
+		for k, v := range m.fragments {
+			if f := fragments[k]; f != nil {
+				return nil, errors.New(m.file + ": the fragment " + k + " repeat with " + f.mapper.file)
+			}
+			fragments[k] = &mapperFragment{el: v, mapper: m}
+		}
+		for k, v := range m.resultMaps {
+			if resultMaps[k] != nil {
+				return nil, errors.New(m.file + ": the resultMap " + k + " repeat")
+			}
+			resultMaps[k] = v.clone()
+		}
+	}
+	for _, m := range mappers {
+		for k := range m.resultMaps {
+			err := resultMaps[k].resolve(resultMaps)
+			if err != nil {
+				return nil, errors.New(m.file + ": " + err.Error())
+			}
+		}
+	}
+
+	ret := map[string]*SqlTemplate{}
+	for _, m := range mappers {
+		for _, e := range m.sqls {
+			id := e.SelectAttrValue("id", "")
+			if id == "" {
+				return nil, errors.New(m.file + ": " + m.namespace + " has sql not have ID")
+			}
+			fullId := m.namespace + "." + id
+			if _, ok := ret[fullId]; ok {
+				return nil, errors.New(m.file + ": " + fullId + " repeat")
+			}
+			marks, err := newSqlMarks()
+			if err != nil {
+				return nil, err
+			}
+			compiler := &sqlCompiler{
+				sqlMarks:  marks,
+				id:        fullId,
+				namespace: m.namespace,
+				fragments: fragments,
+			}
+			val, err := compiler.compile(e)
+			if err != nil {
+				return nil, errors.New(m.file + ": " + err.Error())
+			}
+			val = strings.Replace(val, "\n", " ", -1)
+			val = strings.Trim(val, "\n")
+			val = strings.TrimSpace(val)
+			attrs, err := parseStatementAttrs(e, m.attrs)
+			if err != nil {
+				return nil, errors.New(m.file + ": " + fullId + ": " + err.Error())
+			}
+			var rm *resultMap
+			if ref := e.SelectAttrValue("resultMap", ""); ref != "" {
+				rm = resultMaps[m.namespace+"."+ref]
+				if rm == nil {
+					rm = resultMaps[ref]
+				}
+				if rm == nil {
+					return nil, errors.New(m.file + ": the resultMap " + ref + " of " + fullId + " is not found")
+				}
+			}
+			var flushes []string
+			if attrs.flushCache {
+				flushes = flushNamespaces(m.namespace, dependents)
+			}
+			ret[fullId] = &SqlTemplate{
+				key:       fullId,
+				namespace: m.namespace,
+				sql:       val,
+				marks:     compiler.sqlMarks,
+				resultMap: rm,
+				attrs:     attrs,
+				flushes:   flushes,
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+/// get the namespace and its dependent namespaces to flush the cache
+/// @param namespace: the namespace of the write statement
+/// @param dependents: the namespaces that depend on the namespace as the value
+func flushNamespaces(namespace string, dependents map[string][]string) []string {
+	ret := []string{namespace}
+	seen := map[string]bool{namespace: true}
+	for i := 0; i < len(ret); i++ {
+		for _, ns := range dependents[ret[i]] {
+			if !seen[ns] {
+				seen[ns] = true
+				ret = append(ret, ns)
+			}
+		}
+	}
+	return ret
+}
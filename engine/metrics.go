@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/zhaobingss/sqlmap/log"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// the upper bounds in seconds of the duration histogram buckets
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+/// the snapshot of the engine metrics
+type MetricsSnapshot struct {
+	Statements []StatementMetrics // the metrics of the statements, sorted by the key
+	Pool       sql.DBStats        // the connection pool stats of the primary db
+	Replicas   []sql.DBStats      // the connection pool stats of the replicas, in the order they are added
+}
+
+/// the metrics of the statement
+type StatementMetrics struct {
+	Key         string            // sql map key, namespace + sql ID
+	Calls       int64             // the count of the executions
+	Errors      int64             // the count of the executions that fail
+	Rows        int64             // the count of the rows returned or affected
+	DurationSum time.Duration     // the total duration of the executions
+	Buckets     []HistogramBucket // the cumulative duration histogram, the last bucket is +Inf
+}
+
+/// the bucket of the duration histogram
+type HistogramBucket struct {
+	UpperBound float64 // the upper bound in seconds, +Inf for the last bucket
+	Count      int64   // the count of the executions not longer than the upper bound
+}
+
+/// the metrics recorder of the statements
+type metrics struct {
+	lock       sync.Mutex
+	buckets    []float64
+	statements map[string]*statementMetrics
+}
+
+/// the metrics of the statement
+type statementMetrics struct {
+	calls       int64
+	errors      int64
+	rows        int64
+	durationSum time.Duration
+	counts      []int64 // the count of the executions in each bucket, not cumulative
+}
+
+/// create the metrics recorder
+/// @param buckets: the upper bounds in seconds of the duration histogram buckets
+func newMetrics(buckets []float64) *metrics {
+	m := &metrics{}
+	m.reset(buckets)
+	return m
+}
+
+/// set the upper bounds of the buckets and clear the recorded metrics
+/// @param buckets: the upper bounds in seconds of the duration histogram buckets
+func (m *metrics) reset(buckets []float64) {
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.buckets = b
+	m.statements = map[string]*statementMetrics{}
+}
+
+/// record the execution of the statement
+/// @param key: sql map key, namespace + sql ID
+/// @param d: the duration of the execution
+/// @param rows: the count of the rows returned or affected
+/// @param err: the error of the execution
+func (m *metrics) record(key string, d time.Duration, rows int64, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	sm := m.statements[key]
+	if sm == nil {
+		sm = &statementMetrics{counts: make([]int64, len(m.buckets)+1)}
+		m.statements[key] = sm
+	}
+	sm.calls++
+	if err != nil {
+		sm.errors++
+	}
+	sm.rows += rows
+	sm.durationSum += d
+	i := sort.SearchFloat64s(m.buckets, d.Seconds())
+	sm.counts[i]++
+}
+
+/// get the snapshot of the statements metrics
+func (m *metrics) snapshot() []StatementMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]StatementMetrics, 0, len(m.statements))
+	for key, sm := range m.statements {
+		buckets := make([]HistogramBucket, len(sm.counts))
+		count := int64(0)
+		for i, c := range sm.counts {
+			count += c
+			bound := math.Inf(1)
+			if i < len(m.buckets) {
+				bound = m.buckets[i]
+			}
+			buckets[i] = HistogramBucket{UpperBound: bound, Count: count}
+		}
+		ret = append(ret, StatementMetrics{
+			Key:         key,
+			Calls:       sm.calls,
+			Errors:      sm.errors,
+			Rows:        sm.rows,
+			DurationSum: sm.durationSum,
+			Buckets:     buckets,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+/// set the upper bounds of the duration histogram buckets and reset the metrics
+/// @param buckets: the upper bounds in seconds
+func (s *SqlEngine) SetMetricsBuckets(buckets []float64) {
+	s.metrics.reset(buckets)
+}
+
+/// get the snapshot of the statements metrics and the connection pool stats of the primary and the replicas
+func (s *SqlEngine) Metrics() MetricsSnapshot {
+	s.checkInit()
+	return MetricsSnapshot{
+		Statements: s.metrics.snapshot(),
+		Pool:       s.db.Stats(),
+		Replicas:   s.replicas.stats(),
+	}
+}
+
+/// write the metrics in the Prometheus text format,
+/// the pool metrics are labeled by the pool, eg: pool="primary", pool="replica-0"
+/// @param w: the writer
+func (s *SqlEngine) WriteMetrics(w io.Writer) error {
+	snapshot := s.Metrics()
+	bw := bufio.NewWriter(w)
+
+	writeHeader(bw, "sqlmap_statement_calls_total", "counter", "The count of the statement executions.")
+	for _, sm := range snapshot.Statements {
+		fmt.Fprintf(bw, "sqlmap_statement_calls_total{key=%s} %d\n", quoteLabel(sm.Key), sm.Calls)
+	}
+	writeHeader(bw, "sqlmap_statement_errors_total", "counter", "The count of the statement executions that fail.")
+	for _, sm := range snapshot.Statements {
+		fmt.Fprintf(bw, "sqlmap_statement_errors_total{key=%s} %d\n", quoteLabel(sm.Key), sm.Errors)
+	}
+	writeHeader(bw, "sqlmap_statement_rows_total", "counter", "The count of the rows returned or affected by the statement.")
+	for _, sm := range snapshot.Statements {
+		fmt.Fprintf(bw, "sqlmap_statement_rows_total{key=%s} %d\n", quoteLabel(sm.Key), sm.Rows)
+	}
+	writeHeader(bw, "sqlmap_statement_duration_seconds", "histogram", "The duration of the statement executions.")
+	for _, sm := range snapshot.Statements {
+		key := quoteLabel(sm.Key)
+		for _, b := range sm.Buckets {
+			fmt.Fprintf(bw, "sqlmap_statement_duration_seconds_bucket{key=%s,le=\"%s\"} %d\n", key, formatFloat(b.UpperBound), b.Count)
+		}
+		fmt.Fprintf(bw, "sqlmap_statement_duration_seconds_sum{key=%s} %s\n", key, formatFloat(sm.DurationSum.Seconds()))
+		fmt.Fprintf(bw, "sqlmap_statement_duration_seconds_count{key=%s} %d\n", key, sm.Calls)
+	}
+
+	pools := []string{"primary"}
+	stats := []sql.DBStats{snapshot.Pool}
+	for i, r := range snapshot.Replicas {
+		pools = append(pools, "replica-"+strconv.Itoa(i))
+		stats = append(stats, r)
+	}
+	writePool := func(name, typ, help string, value func(p sql.DBStats) float64) {
+		writeHeader(bw, name, typ, help)
+		for i, p := range stats {
+			fmt.Fprintf(bw, "%s{pool=%s} %s\n", name, quoteLabel(pools[i]), formatFloat(value(p)))
+		}
+	}
+	writePool("sqlmap_pool_max_open_connections", "gauge", "The max open connections of the pool.", func(p sql.DBStats) float64 {
+		return float64(p.MaxOpenConnections)
+	})
+	writePool("sqlmap_pool_open_connections", "gauge", "The open connections of the pool.", func(p sql.DBStats) float64 {
+		return float64(p.OpenConnections)
+	})
+	writePool("sqlmap_pool_in_use_connections", "gauge", "The connections in use.", func(p sql.DBStats) float64 {
+		return float64(p.InUse)
+	})
+	writePool("sqlmap_pool_idle_connections", "gauge", "The idle connections.", func(p sql.DBStats) float64 {
+		return float64(p.Idle)
+	})
+	writePool("sqlmap_pool_wait_count_total", "counter", "The count of the waits for a connection.", func(p sql.DBStats) float64 {
+		return float64(p.WaitCount)
+	})
+	writePool("sqlmap_pool_wait_duration_seconds_total", "counter", "The total time waited for a connection.", func(p sql.DBStats) float64 {
+		return p.WaitDuration.Seconds()
+	})
+	writePool("sqlmap_pool_max_idle_closed_total", "counter", "The connections closed due to the max idle connections.", func(p sql.DBStats) float64 {
+		return float64(p.MaxIdleClosed)
+	})
+	writePool("sqlmap_pool_max_idle_time_closed_total", "counter", "The connections closed due to the max idle time.", func(p sql.DBStats) float64 {
+		return float64(p.MaxIdleTimeClosed)
+	})
+	writePool("sqlmap_pool_max_lifetime_closed_total", "counter", "The connections closed due to the max lifetime.", func(p sql.DBStats) float64 {
+		return float64(p.MaxLifetimeClosed)
+	})
+	return bw.Flush()
+}
+
+/// get the http.Handler that serve the metrics in the Prometheus text format,
+/// respond 500 if the metrics fail to write, the error of writing the response is logged
+func (s *SqlEngine) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := &bytes.Buffer{}
+		err := s.WriteMetrics(buf)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, err = w.Write(buf.Bytes())
+		if err != nil {
+			s.getLogger().Log(r.Context(), log.LevelError, "write metrics fail", log.F("error", err))
+		}
+	})
+}
+
+/// write the HELP and TYPE lines of the metric
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+/// quote the label value, escape the backslash, double quote and line feed
+func quoteLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return `"` + v + `"`
+}
+
+/// format the float value, +Inf for the infinity
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/// the regex to match the bound param #{name} and the raw param ${name} in the statement
+var paramReg, _ = regexp.Compile(`([#$])\{\s*([^{}\s]+)\s*\}`)
+
+/// replace the #{name} mark in sql with placeholder and collect the bound args,
+/// the ${name} mark will be replaced with the param value as raw sql text
+/// @param sqlStr: the rendered sql with the param marks
+/// @param marks: the regex to match the param marks that the #{name} and ${name} compiled to
+/// @param param: the param to pass to the sql template
+/// @param d: the dialect to render the placeholder
+/// @return string: the sql with placeholder
+/// @return []interface{}: the bound args
+/// @return error
+func bindParams(sqlStr string, marks *regexp.Regexp, param interface{}, d Dialect) (string, []interface{}, error) {
+	matches := marks.FindAllStringSubmatchIndex(sqlStr, -1)
+	if len(matches) == 0 {
+		return sqlStr, nil, nil
+	}
+
+	buf := strings.Builder{}
+	args := make([]interface{}, 0, len(matches))
+	last := 0
+	for _, m := range matches {
+		buf.WriteString(sqlStr[last:m[0]])
+		last = m[1]
+		kind := sqlStr[m[2]:m[3]]
+		path := sqlStr[m[4]:m[5]]
+		val, err := resolveParam(param, path)
+		if err != nil {
+			return "", nil, err
+		}
+		if kind == markBind {
+			args = append(args, val)
+			buf.WriteString(d.Placeholder(len(args)))
+		} else {
+			buf.WriteString(rawParam(val))
+		}
+	}
+	buf.WriteString(sqlStr[last:])
+	return buf.String(), args, nil
+}
+
+/// split the param path by dot, the name quoted like "y.z" is a whole name, the foreach quote the key of the item
+func splitParamPath(path string) ([]string, error) {
+	var names []string
+	for {
+		if !strings.HasPrefix(path, `"`) {
+			i := strings.Index(path, ".")
+			if i < 0 {
+				return append(names, path), nil
+			}
+			names = append(names, path[:i])
+			path = path[i+1:]
+			continue
+		}
+		i := 1
+		for i < len(path) && path[i] != '"' {
+			if path[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i >= len(path) {
+			return nil, errors.New("the quoted name is not closed")
+		}
+		name, err := strconv.Unquote(path[:i+1])
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		path = path[i+1:]
+		if path == "" {
+			return names, nil
+		}
+		if path[0] != '.' {
+			return nil, errors.New("the quoted name is not followed by dot")
+		}
+		path = path[1:]
+	}
+}
+
+/// get the value from the param by the path, eg: name, user.name, ids.0, m."y.z"
+/// the struct field is matched by the field name first then the db tag,
+/// the path . means the param itself and the path start with . like .0 is relative to the param
+/// @param param: the param to pass to the sql template
+/// @param path: the param path split by dot
+func resolveParam(param interface{}, path string) (interface{}, error) {
+	if path == "." {
+		return param, nil
+	}
+	names, err := splitParamPath(strings.TrimPrefix(path, "."))
+	if err != nil {
+		return nil, errors.New("can't resolve param " + path + ": " + err.Error())
+	}
+	val := reflect.ValueOf(param)
+	for _, name := range names {
+		val = deRefValue(val)
+		if !val.IsValid() {
+			return nil, errors.New("can't resolve param " + path + ": the value before " + name + " is nil")
+		}
+		next, err := paramField(val, name)
+		if err != nil {
+			return nil, fmt.Errorf("can't resolve param %s: %s", path, err)
+		}
+		val = next
+	}
+	if !val.IsValid() || !val.CanInterface() {
+		return nil, nil
+	}
+	return val.Interface(), nil
+}
+
+/// get the child value of the struct, map, slice or array by the name
+func paramField(val reflect.Value, name string) (reflect.Value, error) {
+	switch val.Kind() {
+	case reflect.Struct:
+		typ := val.Type()
+		if sf, ok := typ.FieldByName(name); ok && sf.PkgPath == "" {
+			return val.FieldByIndex(sf.Index), nil
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			sf := typ.Field(i)
+			if sf.PkgPath == "" && sf.Tag.Get(`db`) == name {
+				return val.Field(i), nil
+			}
+		}
+		return reflect.Value{}, errors.New("the struct " + typ.String() + " has no field " + name)
+	case reflect.Map:
+		key, err := paramMapKey(val, name)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v := val.MapIndex(key)
+		if !v.IsValid() {
+			return reflect.Value{}, errors.New("the map " + val.Type().String() + " has no key " + name)
+		}
+		return v, nil
+	case reflect.Slice, reflect.Array:
+		i, err := strconv.Atoi(name)
+		if err != nil || i < 0 || i >= val.Len() {
+			return reflect.Value{}, errors.New("the index " + name + " is out of range")
+		}
+		return val.Index(i), nil
+	default:
+		return reflect.Value{}, fmt.Errorf("can't get %s from %s", name, val.Kind())
+	}
+}
+
+/// convert the name to the map key type
+func paramMapKey(m reflect.Value, name string) (reflect.Value, error) {
+	typ := m.Type().Key()
+	switch typ.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(name).Convert(typ), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(name, 10, 64)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(i).Convert(typ), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(i).Convert(typ), nil
+	}
+	for _, k := range m.MapKeys() {
+		if fmt.Sprint(k.Interface()) == name {
+			return k, nil
+		}
+	}
+	return reflect.Zero(typ), nil
+}
+
+/// format the value as raw sql text
+func rawParam(val interface{}) string {
+	v := deRefValue(reflect.ValueOf(val))
+	if !v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+/// get the value that not a pointer or interface
+func deRefValue(val reflect.Value) reflect.Value {
+	for val.IsValid() && (val.Kind() == reflect.Ptr || val.Kind() == reflect.Interface) {
+		if val.IsNil() {
+			return reflect.Value{}
+		}
+		val = val.Elem()
+	}
+	return val
+}
@@ -0,0 +1,214 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/zhaobingss/sqlmap/log"
+	"github.com/zhaobingss/sqlmap/util"
+	"os"
+	"time"
+)
+
+/// the state of the *.goxml file when it was loaded
+type fileStat struct {
+	modTime time.Time
+	size    int64
+}
+
+/// the watcher that poll the *.goxml files and reload the changed files
+type sqlWatcher struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+/// watch the *.goxml files of the sql dir and reload the changed files by polling,
+/// if the changed files fail to parse, the previous statements are kept
+/// @param interval: the polling interval
+func (s *SqlEngine) Watch(interval time.Duration) error {
+	s.checkInit()
+	if interval <= 0 {
+		return errors.New("the watch interval must be positive")
+	}
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	if s.sqlDir == "" {
+		return errors.New("the engine is not init with the sql dir")
+	}
+	if s.watcher != nil {
+		return errors.New("the engine is already watching")
+	}
+	w := &sqlWatcher{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.watcher = w
+	go s.watch(w, interval)
+	return nil
+}
+
+/// stop watching the *.goxml files
+func (s *SqlEngine) StopWatch() {
+	s.reloadLock.Lock()
+	w := s.watcher
+	s.watcher = nil
+	s.reloadLock.Unlock()
+	if w != nil {
+		close(w.stop)
+		<-w.done
+	}
+}
+
+/// poll the *.goxml files until the watcher stop
+/// @param w: the watcher
+/// @param interval: the polling interval
+func (s *SqlEngine) watch(w *sqlWatcher, interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			// the same error is returned until the files change again, log it once
+			err := s.Reload()
+			if err != nil && err != lastErr {
+				s.getLogger().Log(context.Background(), log.LevelError,
+					"reload the *.goxml files fail, keep the previous statements", log.F("error", err))
+			}
+			lastErr = err
+		}
+	}
+}
+
+/// reload the changed, added and removed *.goxml files of the sql dir,
+/// the statements are swapped only when all the files parse and compile success
+func (s *SqlEngine) Reload() error {
+	s.checkInit()
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	if s.sqlDir == "" {
+		return errors.New("the engine is not init with the sql dir")
+	}
+
+	files, err := util.GetFiles(s.sqlDir)
+	if err != nil {
+		return err
+	}
+	stats := make(map[string]fileStat, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		stats[f] = fileStat{modTime: fi.ModTime(), size: fi.Size()}
+	}
+	// the files fail to reload last time and not change again
+	if s.failErr != nil && sameFileStats(s.failStats, stats) {
+		return s.failErr
+	}
+	err = s.reloadFiles(files, stats)
+	if err != nil {
+		s.failStats = stats
+		s.failErr = err
+		return err
+	}
+	s.failStats = nil
+	s.failErr = nil
+	return nil
+}
+
+/// reload the *.goxml files and swap the statements
+/// @param files: the *.goxml files of the sql dir
+/// @param stats: the state of the files before they were read
+func (s *SqlEngine) reloadFiles(files []string, stats map[string]fileStat) error {
+	mappers := make([]*mapperFile, 0, len(files))
+	changed := make([]string, 0)
+	for _, f := range files {
+		stat := stats[f]
+		old, ok := s.fileStats[f]
+		if ok && old == stat && s.mappers[f] != nil {
+			mappers = append(mappers, s.mappers[f])
+			continue
+		}
+		m, err := s.readMapperFile(f)
+		if err != nil {
+			return err
+		}
+		mappers = append(mappers, m)
+		changed = append(changed, f)
+	}
+	for f := range s.fileStats {
+		if _, ok := stats[f]; !ok {
+			changed = append(changed, f)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	m, err := compileMapperFiles(mappers)
+	if err != nil {
+		return err
+	}
+	// reuse the compiled template of the unchanged statement, and compile the changed
+	// statement before swap to keep the previous statements if it fail
+	s.lock.RLock()
+	tb := s.tplBuilder
+	for k, v := range m {
+		old := s.sqlMap[k]
+		if old != nil && old.sql == v.sql {
+			v.tpl = old.tpl
+		}
+	}
+	s.lock.RUnlock()
+	for _, v := range m {
+		if v.tpl == nil {
+			v.tpl, err = tb.New(v.key, v.sql)
+			if err != nil {
+				return errors.New(v.key + ": " + err.Error())
+			}
+		}
+	}
+
+	s.lock.Lock()
+	if s.tplBuilder != tb {
+		// the template builder is replaced while compiling, build the templates again when use
+		for _, v := range m {
+			v.tpl = nil
+		}
+	}
+	s.sqlMap = m
+	s.lock.Unlock()
+	s.setMapperFiles(mappers, stats)
+	logger := s.getLogger()
+	for _, f := range changed {
+		logger.Log(context.Background(), log.LevelInfo, "reload the *.goxml file", log.F("file", f))
+	}
+	return nil
+}
+
+/// check if the states of the files are the same
+func sameFileStats(a, b map[string]fileStat) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if vv, ok := b[k]; !ok || vv != v {
+			return false
+		}
+	}
+	return true
+}
+
+/// remember the loaded *.goxml files to detect the change when reload
+/// @param mappers: the parsed *.goxml files
+/// @param stats: the state of the files before they were read
+func (s *SqlEngine) setMapperFiles(mappers []*mapperFile, stats map[string]fileStat) {
+	s.mappers = make(map[string]*mapperFile, len(mappers))
+	for _, m := range mappers {
+		s.mappers[m.file] = m
+	}
+	s.fileStats = stats
+}
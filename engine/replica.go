@@ -0,0 +1,236 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/zhaobingss/sqlmap/log"
+	"sync"
+	"time"
+)
+
+/// the policy to choose the replica for the query
+type ReplicaPolicy int
+
+const (
+	ReplicaRoundRobin ReplicaPolicy = iota // choose the healthy replicas in turn
+	ReplicaWeighted                        // choose the healthy replicas in proportion to the weights
+)
+
+/// the replica db that serve the queries outside the transaction
+type replica struct {
+	db      *sql.DB
+	weight  int
+	current int  // the current weight of the smooth weighted round-robin
+	healthy bool // the replica pass the last health check
+}
+
+/// the replicas of the engine
+type replicaPool struct {
+	lock     sync.Mutex
+	policy   ReplicaPolicy
+	replicas []*replica
+	next     int           // the index of the next replica of the round-robin
+	checker  *replicaCheck // the health check running in background
+}
+
+/// the health check that ping the replicas in background
+type replicaCheck struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+/// the context key of the queries routed to the primary
+type useMasterKey struct{}
+
+/// derive the context that route the queries to the primary db instead of the replicas
+/// @param ctx: the context of the execution
+func UseMaster(ctx context.Context) context.Context {
+	return context.WithValue(ctx, useMasterKey{}, true)
+}
+
+/// check if the ctx route the queries to the primary db
+/// @param ctx: the context of the execution
+func isUseMaster(ctx context.Context) bool {
+	useMaster, _ := ctx.Value(useMasterKey{}).(bool)
+	return useMaster
+}
+
+/// add the replica db, the queries outside the transaction are routed to the replicas,
+/// the writes and the session are always executed on the primary db, the query routed to the primary
+/// not use the cache, but the query on the lagged replica may cache the data before the write that flushed it
+/// until the ttl expire, use useMaster for the query must read the write
+/// @param db: the replica db
+/// @param weight: the weight of the ReplicaWeighted policy, 1 if it is not positive
+func (s *SqlEngine) AddReplica(db *sql.DB, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	s.replicas.lock.Lock()
+	defer s.replicas.lock.Unlock()
+	s.replicas.replicas = append(s.replicas.replicas, &replica{db: db, weight: weight, healthy: true})
+}
+
+/// set the policy to choose the replica, the default is ReplicaRoundRobin
+/// @param p: the policy
+func (s *SqlEngine) SetReplicaPolicy(p ReplicaPolicy) {
+	s.replicas.lock.Lock()
+	defer s.replicas.lock.Unlock()
+	s.replicas.policy = p
+}
+
+/// ping the replicas, evict the unhealthy ones from the routing and restore the recovered ones
+/// @param ctx: the context of the ping
+func (s *SqlEngine) CheckReplicas(ctx context.Context) {
+	s.replicas.lock.Lock()
+	replicas := append([]*replica{}, s.replicas.replicas...)
+	s.replicas.lock.Unlock()
+
+	for i, r := range replicas {
+		err := r.db.PingContext(ctx)
+		s.replicas.lock.Lock()
+		changed := r.healthy != (err == nil)
+		r.healthy = err == nil
+		if changed {
+			// restart the smooth weighted round-robin of the replica
+			r.current = 0
+		}
+		s.replicas.lock.Unlock()
+		if !changed {
+			continue
+		}
+		if err != nil {
+			s.getLogger().Log(ctx, log.LevelWarn, "evict the unhealthy replica", log.F("replica", i), log.F("error", err))
+		} else {
+			s.getLogger().Log(ctx, log.LevelInfo, "restore the recovered replica", log.F("replica", i))
+		}
+	}
+}
+
+/// check the replicas periodically in background
+/// @param interval: the interval of the health check, the ping timeout is the interval too
+func (s *SqlEngine) StartHealthCheck(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("the health check interval must be positive")
+	}
+	s.replicas.lock.Lock()
+	defer s.replicas.lock.Unlock()
+	if s.replicas.checker != nil {
+		return errors.New("the health check is already started")
+	}
+	c := &replicaCheck{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.replicas.checker = c
+	go s.healthCheck(c, interval)
+	return nil
+}
+
+/// stop the health check of the replicas
+func (s *SqlEngine) StopHealthCheck() {
+	s.replicas.lock.Lock()
+	c := s.replicas.checker
+	s.replicas.checker = nil
+	s.replicas.lock.Unlock()
+	if c != nil {
+		close(c.stop)
+		<-c.done
+	}
+}
+
+/// ping the replicas until the health check stop
+/// @param c: the health check
+/// @param interval: the interval of the health check
+func (s *SqlEngine) healthCheck(c *replicaCheck, interval time.Duration) {
+	defer close(c.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			s.CheckReplicas(ctx)
+			cancel()
+		}
+	}
+}
+
+/// query on the db chosen by the ctx, use as the queryFunc outside the transaction
+/// @param ctx: the context of the execution
+/// @param query: the sql to execute
+/// @param args: the args bound to the sql
+func (s *SqlEngine) readQuery(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.reader(ctx).QueryContext(ctx, query, args...)
+}
+
+/// choose the db of the query, the primary if the ctx use master or no replica is healthy
+/// @param ctx: the context of the execution
+func (s *SqlEngine) reader(ctx context.Context) *sql.DB {
+	if isUseMaster(ctx) {
+		return s.db
+	}
+	if db := s.replicas.choose(); db != nil {
+		return db
+	}
+	return s.db
+}
+
+/// get the connection pool stats of the replicas
+func (p *replicaPool) stats() []sql.DBStats {
+	p.lock.Lock()
+	replicas := append([]*replica{}, p.replicas...)
+	p.lock.Unlock()
+	ret := make([]sql.DBStats, 0, len(replicas))
+	for _, r := range replicas {
+		ret = append(ret, r.db.Stats())
+	}
+	return ret
+}
+
+/// check if there is any replica
+func (p *replicaPool) empty() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.replicas) == 0
+}
+
+/// choose a healthy replica by the policy, nil if there is not
+func (p *replicaPool) choose() *sql.DB {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.policy == ReplicaWeighted {
+		return p.chooseWeighted()
+	}
+	for i := range p.replicas {
+		r := p.replicas[(p.next+i)%len(p.replicas)]
+		if r.healthy {
+			p.next = (p.next + i + 1) % len(p.replicas)
+			return r.db
+		}
+	}
+	return nil
+}
+
+/// choose a healthy replica by the smooth weighted round-robin
+func (p *replicaPool) chooseWeighted() *sql.DB {
+	total := 0
+	var best *replica
+	for _, r := range p.replicas {
+		if !r.healthy {
+			continue
+		}
+		r.current += r.weight
+		total += r.weight
+		if best == nil || r.current > best.current {
+			best = r
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	best.current -= total
+	return best.db
+}
@@ -0,0 +1,489 @@
+package engine
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/beevik/etree"
+	"reflect"
+	"strings"
+)
+
+/// the <resultMap> element that map the column to the struct field
+type resultMap struct {
+	id        string            // the result map full ID, namespace + result map ID
+	namespace string            // the namespace to resolve the referred result map
+	ids       []string          // the <id> columns that identify the struct in the joined rows
+	columns   map[string]string // the <id> and <result> mapping, column as the key and property as the value
+	nested    []*nestedMap      // the <association> and <collection> mapping
+}
+
+/// the <association> and <collection> element in the <resultMap>
+type nestedMap struct {
+	property     string     // the struct field, the field type is the nested struct or the slice of it
+	columnPrefix string     // the prefix of the nested struct columns
+	ref          string     // the referred result map ID, empty for the inline mapping
+	collection   bool       // true for <collection>, false for <association>
+	resultMap    *resultMap // the mapping of the nested struct
+}
+
+/// parse the <resultMap> element
+/// @param namespace: the namespace of the *.goxml file
+/// @param id: the result map full ID
+/// @param e: the <resultMap> element
+func parseResultMap(namespace, id string, e *etree.Element) (*resultMap, error) {
+	rm := &resultMap{
+		id:        id,
+		namespace: namespace,
+		columns:   map[string]string{},
+	}
+	for _, child := range e.ChildElements() {
+		switch child.Tag {
+		case "id", "result":
+			column := child.SelectAttrValue("column", "")
+			property := child.SelectAttrValue("property", "")
+			if column == "" || property == "" {
+				return nil, errors.New("the resultMap " + id + " has <" + child.Tag + "> without column or property")
+			}
+			if _, ok := rm.columns[column]; ok {
+				return nil, errors.New("the resultMap " + id + " has column " + column + " repeat")
+			}
+			rm.columns[column] = property
+			if child.Tag == "id" {
+				rm.ids = append(rm.ids, column)
+			}
+		case "association", "collection":
+			property := child.SelectAttrValue("property", "")
+			if property == "" {
+				return nil, errors.New("the resultMap " + id + " has <" + child.Tag + "> without property")
+			}
+			n := &nestedMap{
+				property:     property,
+				columnPrefix: child.SelectAttrValue("columnPrefix", ""),
+				ref:          child.SelectAttrValue("resultMap", ""),
+				collection:   child.Tag == "collection",
+			}
+			if n.ref == "" {
+				inline, err := parseResultMap(namespace, id+"."+property, child)
+				if err != nil {
+					return nil, err
+				}
+				n.resultMap = inline
+			}
+			rm.nested = append(rm.nested, n)
+		default:
+			return nil, errors.New("the resultMap " + id + " has unknown element <" + child.Tag + ">")
+		}
+	}
+	return rm, nil
+}
+
+/// copy the result map and its inline nested maps to resolve, the columns are shared as they are never changed
+func (rm *resultMap) clone() *resultMap {
+	c := *rm
+	c.nested = make([]*nestedMap, len(rm.nested))
+	for i, n := range rm.nested {
+		nc := *n
+		if n.ref == "" {
+			nc.resultMap = n.resultMap.clone()
+		} else {
+			nc.resultMap = nil
+		}
+		c.nested[i] = &nc
+	}
+	return &c
+}
+
+/// resolve the referred result map of the <association> and <collection>
+/// @param resultMaps: all the result maps, namespace + result map ID as the key
+func (rm *resultMap) resolve(resultMaps map[string]*resultMap) error {
+	for _, n := range rm.nested {
+		if n.ref == "" {
+			err := n.resultMap.resolve(resultMaps)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		n.resultMap = resultMaps[rm.namespace+"."+n.ref]
+		if n.resultMap == nil {
+			n.resultMap = resultMaps[n.ref]
+		}
+		if n.resultMap == nil {
+			return errors.New("the resultMap " + n.ref + " of " + rm.id + "." + n.property + " is not found")
+		}
+	}
+	return nil
+}
+
+/// get the property of the column, empty if the column is not mapped
+func (rm *resultMap) property(column string) string {
+	if rm == nil {
+		return ""
+	}
+	return rm.columns[column]
+}
+
+/// check if the result map has the <association> or <collection>
+func (rm *resultMap) hasNested() bool {
+	return rm != nil && len(rm.nested) > 0
+}
+
+/// get the struct field by the property, eg: Name, Parent.Name
+/// the nil pointer field in the property path will be allocated
+/// @param val: the struct value
+/// @param property: the field name path split by dot
+func propertyField(val reflect.Value, property string) (reflect.Value, error) {
+	for _, name := range strings.Split(property, ".") {
+		for val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
+		if val.Kind() != reflect.Struct {
+			return reflect.Value{}, errors.New("the property " + property + " is not in a struct")
+		}
+		field := val.FieldByName(name)
+		if !field.IsValid() || !field.CanSet() {
+			return reflect.Value{}, errors.New("the property " + property + " is not found in " + val.Type().String())
+		}
+		val = field
+	}
+	return val, nil
+}
+
+/// get the struct field type by the property, eg: Name, Parent.Name
+func propertyType(typ reflect.Type, property string) (reflect.Type, error) {
+	for _, name := range strings.Split(property, ".") {
+		typ = deRefType(typ)
+		if typ.Kind() != reflect.Struct {
+			return nil, errors.New("the property " + property + " is not in a struct")
+		}
+		sf, ok := typ.FieldByName(name)
+		if !ok || sf.PkgPath != "" {
+			return nil, errors.New("the property " + property + " is not found in " + typ.String())
+		}
+		typ = sf.Type
+	}
+	return typ, nil
+}
+
+/// the plan to set the columns of a row to a struct and its nested structs
+type resultPlan struct {
+	typ    reflect.Type   // the struct type
+	prefix string         // the column prefix of the struct
+	fields map[int]string // the column index to the property
+	ids    []int          // the <id> column index that identify the struct, empty for all the fields
+	nested []*nestedPlan  // the plan of the <association> and <collection>
+}
+
+/// the plan of the <association> and <collection>
+type nestedPlan struct {
+	*resultPlan
+	property   string // the struct field of the nested struct
+	collection bool   // true for <collection>, false for <association>
+	isPtr      bool   // the association field or the collection element is a pointer
+}
+
+/// the struct that created from the rows, and its nested structs
+type resultNode struct {
+	ptr    reflect.Value  // the pointer to the struct
+	nested []*resultNodes // the nested structs of each nested plan
+}
+
+/// the structs identified by the key columns
+type resultNodes struct {
+	list []*resultNode
+	keys map[string]*resultNode
+}
+
+/// create the empty result nodes
+func newResultNodes() *resultNodes {
+	return &resultNodes{keys: map[string]*resultNode{}}
+}
+
+/// build the plan of the columns by the result map
+/// @param rm: the result map that has nested mapping
+/// @param typ: the struct type
+/// @param columns: the columns of the rows
+func buildResultPlan(rm *resultMap, typ reflect.Type, columns []string) (*resultPlan, error) {
+	index := map[string]int{}
+	for i, c := range columns {
+		index[c] = i
+	}
+	claimed := make([]bool, len(columns))
+	plan, err := buildNestedPlan(rm, typ, "", columns, index, claimed, nil)
+	if err != nil {
+		return nil, err
+	}
+	plan.autoMap(columns, claimed, true)
+	return plan, nil
+}
+
+/// build the plan of the result map with the column prefix
+func buildNestedPlan(rm *resultMap, typ reflect.Type, prefix string, columns []string, index map[string]int, claimed []bool, parents []*resultMap) (*resultPlan, error) {
+	plan := &resultPlan{
+		typ:    typ,
+		prefix: prefix,
+		fields: map[int]string{},
+	}
+	for column, property := range rm.columns {
+		i, ok := index[prefix+column]
+		if !ok {
+			continue
+		}
+		if _, err := propertyType(typ, property); err != nil {
+			return nil, errors.New("the resultMap " + rm.id + ": " + err.Error())
+		}
+		plan.fields[i] = property
+		claimed[i] = true
+	}
+	for _, column := range rm.ids {
+		if i, ok := index[prefix+column]; ok {
+			plan.ids = append(plan.ids, i)
+		}
+	}
+
+	parents = append(parents, rm)
+	for _, n := range rm.nested {
+		ft, err := propertyType(typ, n.property)
+		if err != nil {
+			return nil, errors.New("the resultMap " + rm.id + ": " + err.Error())
+		}
+		if n.collection {
+			if ft.Kind() != reflect.Slice {
+				return nil, errors.New("the resultMap " + rm.id + ": the collection " + n.property + " must be a slice")
+			}
+			ft = ft.Elem()
+		}
+		isPtr := ft.Kind() == reflect.Ptr
+		ft = deRefType(ft)
+		if ft.Kind() != reflect.Struct {
+			return nil, errors.New("the resultMap " + rm.id + ": the " + n.property + " must be a struct or struct pointer")
+		}
+
+		np := prefix + n.columnPrefix
+		if n.columnPrefix == "" {
+			for _, p := range parents {
+				if p == n.resultMap {
+					return nil, errors.New("the resultMap " + rm.id + ": the recursive " + n.property + " must have columnPrefix")
+				}
+			}
+		}
+		if !hasColumns(n.resultMap, np, columns, index) {
+			continue
+		}
+		child, err := buildNestedPlan(n.resultMap, ft, np, columns, index, claimed, parents)
+		if err != nil {
+			return nil, err
+		}
+		plan.nested = append(plan.nested, &nestedPlan{
+			resultPlan: child,
+			property:   n.property,
+			collection: n.collection,
+			isPtr:      isPtr,
+		})
+	}
+	return plan, nil
+}
+
+/// check if the columns has the column of the result map with the prefix
+func hasColumns(rm *resultMap, prefix string, columns []string, index map[string]int) bool {
+	for column := range rm.columns {
+		if _, ok := index[prefix+column]; ok {
+			return true
+		}
+	}
+	if prefix == "" {
+		return false
+	}
+	for _, c := range columns {
+		if strings.HasPrefix(c, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/// map the columns that not in the result map to the struct field by the db tag,
+/// the nested struct only map the columns with its prefix
+func (p *resultPlan) autoMap(columns []string, claimed []bool, root bool) {
+	if root || p.prefix != "" {
+		for i, c := range columns {
+			if claimed[i] || !strings.HasPrefix(c, p.prefix) {
+				continue
+			}
+			name := c[len(p.prefix):]
+			for j := 0; j < p.typ.NumField(); j++ {
+				sf := p.typ.Field(j)
+				if sf.PkgPath == "" && sf.Tag.Get(`db`) == name {
+					p.fields[i] = sf.Name
+					claimed[i] = true
+					break
+				}
+			}
+		}
+	}
+	for _, n := range p.nested {
+		n.autoMap(columns, claimed, false)
+	}
+}
+
+/// get the key of the struct in the row
+/// @param raw: the row values
+/// @return string: the key
+/// @return bool: false if all the columns of the struct are null
+func (p *resultPlan) key(raw []interface{}) (string, bool) {
+	buf := &strings.Builder{}
+	notNull := false
+	if len(p.ids) > 0 {
+		for _, i := range p.ids {
+			notNull = notNull || raw[i] != nil
+			fmt.Fprintf(buf, "%v\x00", raw[i])
+		}
+		return buf.String(), notNull
+	}
+	for i := range raw {
+		if _, ok := p.fields[i]; ok {
+			notNull = notNull || raw[i] != nil
+			fmt.Fprintf(buf, "%d:%v\x00", i, raw[i])
+		}
+	}
+	return buf.String(), notNull
+}
+
+/// collect the struct of the row to the nodes, and set the scan dest of the new struct fields
+/// @param raw: the row values
+/// @param nodes: the structs that already collected
+/// @param dests: the scan dest of the row
+/// @param root: the root struct will be collected even if all the columns are null
+func (p *resultPlan) collect(raw []interface{}, nodes *resultNodes, dests []interface{}, root bool) error {
+	key, notNull := p.key(raw)
+	if !notNull && !root {
+		return nil
+	}
+	node := nodes.keys[key]
+	if node == nil {
+		node = &resultNode{
+			ptr:    reflect.New(p.typ),
+			nested: make([]*resultNodes, len(p.nested)),
+		}
+		for i := range node.nested {
+			node.nested[i] = newResultNodes()
+		}
+		for i, property := range p.fields {
+			f, err := propertyField(node.ptr.Elem(), property)
+			if err != nil {
+				return err
+			}
+			dests[i] = f.Addr().Interface()
+		}
+		nodes.list = append(nodes.list, node)
+		nodes.keys[key] = node
+	}
+	for i, n := range p.nested {
+		err := n.collect(raw, node.nested[i], dests, false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/// set the collected nested structs to the struct fields
+func (p *resultPlan) finalize(node *resultNode) error {
+	for i, n := range p.nested {
+		children := node.nested[i].list
+		for _, c := range children {
+			err := n.finalize(c)
+			if err != nil {
+				return err
+			}
+		}
+		field, err := propertyField(node.ptr.Elem(), n.property)
+		if err != nil {
+			return err
+		}
+		if n.collection {
+			slice := reflect.MakeSlice(field.Type(), 0, len(children))
+			for _, c := range children {
+				if n.isPtr {
+					slice = reflect.Append(slice, c.ptr)
+				} else {
+					slice = reflect.Append(slice, c.ptr.Elem())
+				}
+			}
+			field.Set(slice)
+		} else if len(children) > 0 {
+			if n.isPtr {
+				field.Set(children[0].ptr)
+			} else {
+				field.Set(children[0].ptr.Elem())
+			}
+		}
+	}
+	return nil
+}
+
+/// set the joined rows to the structs by the nested result map,
+/// the rows with the same <id> columns will be collapsed into one struct
+/// @param rows: the joined rows
+/// @param rm: the result map that has nested mapping
+/// @param typ: the struct type
+/// @param maxRows: the max joined rows to read, 0 for no limit
+/// @return []reflect.Value: the pointers to the structs
+func scanNestedRows(rows *sql.Rows, rm *resultMap, typ reflect.Type, maxRows int) ([]reflect.Value, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	plan, err := buildResultPlan(rm, typ, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := newResultNodes()
+	raw := make([]interface{}, len(columns))
+	holders := make([]interface{}, len(columns))
+	for i := range raw {
+		holders[i] = &raw[i]
+	}
+	count := 0
+	for rows.Next() {
+		count++
+		err = checkMaxRows(count, maxRows)
+		if err != nil {
+			return nil, err
+		}
+		err = rows.Scan(holders...)
+		if err != nil {
+			return nil, err
+		}
+		dests := make([]interface{}, len(columns))
+		for i := range dests {
+			dests[i] = new(interface{})
+		}
+		err = plan.collect(raw, roots, dests, true)
+		if err != nil {
+			return nil, err
+		}
+		err = rows.Scan(dests...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ret := make([]reflect.Value, 0, len(roots.list))
+	for _, node := range roots.list {
+		err = plan.finalize(node)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, node.ptr)
+	}
+	return ret, nil
+}
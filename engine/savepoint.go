@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+/// the valid savepoint name
+var savepointName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+/// create the savepoint in the transaction
+/// @param name: the savepoint name, letters, digits and underscores
+func (s *Session) Savepoint(name string) error {
+	return s.SavepointContext(context.Background(), name)
+}
+
+/// create the savepoint in the transaction
+/// @param ctx: the context of the execution
+/// @param name: the savepoint name, letters, digits and underscores
+func (s *Session) SavepointContext(ctx context.Context, name string) error {
+	err := s.checkSavepoint(name)
+	if err != nil {
+		return err
+	}
+	return s.savepoint(ctx, name)
+}
+
+/// rollback the transaction to the savepoint, the savepoint is kept
+/// @param name: the savepoint name
+func (s *Session) RollbackTo(name string) error {
+	return s.RollbackToContext(context.Background(), name)
+}
+
+/// rollback the transaction to the savepoint, the savepoint is kept
+/// @param ctx: the context of the execution
+/// @param name: the savepoint name
+func (s *Session) RollbackToContext(ctx context.Context, name string) error {
+	err := s.checkSavepoint(name)
+	if err != nil {
+		return err
+	}
+	return s.rollbackToSavepoint(ctx, name)
+}
+
+/// release the savepoint, it does nothing on the database not support it like sqlserver and oracle
+/// @param name: the savepoint name
+func (s *Session) ReleaseSavepoint(name string) error {
+	return s.ReleaseSavepointContext(context.Background(), name)
+}
+
+/// release the savepoint, it does nothing on the database not support it like sqlserver and oracle
+/// @param ctx: the context of the execution
+/// @param name: the savepoint name
+func (s *Session) ReleaseSavepointContext(ctx context.Context, name string) error {
+	err := s.checkSavepoint(name)
+	if err != nil {
+		return err
+	}
+	return s.releaseSavepoint(ctx, name)
+}
+
+/// check the session is in the transaction and the savepoint name is valid
+func (s *Session) checkSavepoint(name string) error {
+	if !s.init {
+		return initError
+	}
+	if s.tx == nil {
+		return ERR_NO_TX
+	}
+	if !savepointName.MatchString(name) {
+		return errors.New("the savepoint name " + name + " is invalid")
+	}
+	return nil
+}
+
+/// get the savepoint sql of the dialect of the engine
+func (s *Session) savepointDialect() SavepointDialect {
+	if d, ok := s.engine.Dialect().(SavepointDialect); ok {
+		return d
+	}
+	return standardSavepoint{}
+}
+
+/// create the savepoint in the transaction
+func (s *Session) savepoint(ctx context.Context, name string) error {
+	_, err := s.tx.ExecContext(ctx, s.savepointDialect().SavepointSQL(name))
+	return err
+}
+
+/// rollback the transaction to the savepoint
+func (s *Session) rollbackToSavepoint(ctx context.Context, name string) error {
+	_, err := s.tx.ExecContext(ctx, s.savepointDialect().RollbackToSavepointSQL(name))
+	return err
+}
+
+/// release the savepoint in the transaction
+func (s *Session) releaseSavepoint(ctx context.Context, name string) error {
+	sqlStr := s.savepointDialect().ReleaseSavepointSQL(name)
+	if sqlStr == "" {
+		return nil
+	}
+	_, err := s.tx.ExecContext(ctx, sqlStr)
+	return err
+}
@@ -1,102 +1,117 @@
 package engine
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
 
-const commitInitStatus = 1
-
 var initError = errors.New("not init correctly")
 
 /// session that manage the transaction
 type Session struct {
-	db          *sql.DB // the database/sql.DB
-	tx          *sql.Tx // transaction
-	commit      int8    // commit count
-	canRollback bool    // flag that indicate if the transaction can rollback
-	init        bool    // flag indicate if the session is already init
+	engine       *SqlEngine      // the engine that own the sql map
+	db           *sql.DB         // the database/sql.DB
+	tx           *sql.Tx         // transaction
+	frames       []*txFrame      // the begun and not ended transaction scopes, the last is the innermost
+	savepoints   int             // the count of the savepoints created by the nested scopes, use for the name
+	rollbackOnly bool            // the transaction can only rollback, the commit will rollback and return error
+	init         bool            // flag indicate if the session is already init
+	txCache      *txCache        // the namespaces flushed in the transaction
+	span         Span            // the span of the transaction, nil if the tracer is not set
+	spanCtx      context.Context // the context carry the span of the transaction, the statement span is its child
 }
 
-/// create a session with sql.DB
-/// @param db: sql.DB
-func newSession(db *sql.DB) *Session {
+/// create a session with the engine
+/// @param engine: the engine that own the sql map and sql.DB
+func newSession(engine *SqlEngine) *Session {
 	return &Session{
-		db:   db,
-		init: true,
+		engine: engine,
+		db:     engine.db,
+		init:   true,
 	}
 }
 
-/// init the session
+/// init the session with the sql.DB, the sql is executed on the db with the sql map of the first init engine,
+/// the session is not init if there is no engine init
+/// Deprecated: use SqlEngine.NewSession or Session.InitEngine, the sql map is owned by the engine
 /// @param db: sql.DB
 func (s *Session) Init(db *sql.DB) {
 	if s.init {
 		return
 	}
+	defaultEngine.lock.Lock()
+	engine := defaultEngine.engine
+	defaultEngine.lock.Unlock()
+	if engine == nil {
+		return
+	}
+	s.engine = engine
 	s.db = db
 	s.init = true
 }
 
-/// begin a transaction
-func (s *Session) BeginTx() error {
-	if !s.init {
-		return initError
-	}
-	s.canRollback = true
-	if s.tx != nil {
-		s.commit++
-		return nil
+/// init the session with the engine
+/// @param engine: the engine that own the sql map and sql.DB
+func (s *Session) InitEngine(engine *SqlEngine) {
+	if s.init {
+		return
 	}
+	s.engine = engine
+	s.db = engine.db
+	s.init = true
+}
 
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
+/// begin a transaction, join the transaction if it is already begun
+func (s *Session) BeginTx() error {
+	return s.BeginTxContext(context.Background(), nil)
+}
 
-	s.tx = tx
-	s.commit = commitInitStatus
-	return nil
+/// begin a transaction, join the transaction if it is already begun
+/// @param ctx: the context of the transaction, the transaction will be rollback if the ctx is done
+/// @param opts: the transaction options, nil for the default
+func (s *Session) BeginTxContext(ctx context.Context, opts *sql.TxOptions) error {
+	return s.BeginTxPropagation(ctx, opts, PropagationRequired)
 }
 
-/// rollback the transaction
+/// rollback the innermost transaction scope not ended, a joined scope mark the transaction as rollback-only,
+/// a nested scope rollback to its savepoint, the committed scopes are skipped like Commit, so the Rollback
+/// after the Commit of a nested scope rollback the enclosing scope, defer the Rollback only after the
+/// outermost BeginTx, or use Transaction for the nested scopes
 func (s *Session) Rollback() error {
 	if !s.init {
 		return initError
 	}
-	if s.tx == nil || !s.canRollback {
-		return nil
-	}
-
-	err := s.tx.Rollback()
-	if err != nil {
+	for len(s.frames) > 0 {
+		frame := s.frames[len(s.frames)-1]
+		s.frames = s.frames[:len(s.frames)-1]
+		if frame.ended {
+			continue
+		}
+		err := s.rollback(frame)
+		s.clearEnded()
 		return err
 	}
-
-	s.tx = nil
 	return nil
 }
 
-/// commit the transaction
+/// commit the transaction scope begun last and not ended, the transaction is committed when the scope began it end,
+/// it is rollback and return ERR_ROLLBACK_ONLY if it is marked as rollback-only
 func (s *Session) Commit() error {
 	if !s.init {
 		return initError
 	}
-	s.canRollback = false
-	if s.tx == nil {
-		return nil
-	}
-
-	if s.commit != commitInitStatus {
-		s.commit--
-		return nil
-	}
-
-	err := s.tx.Commit()
-	if err != nil {
+	for i := len(s.frames) - 1; i >= 0; i-- {
+		frame := s.frames[i]
+		if frame.ended {
+			continue
+		}
+		// keep the committed scope until the scope outside it end, the Transaction check it
+		frame.ended = true
+		err := s.commit(frame)
+		s.clearEnded()
 		return err
 	}
-
-	s.tx = nil
 	return nil
 }
 
@@ -104,13 +119,21 @@ func (s *Session) Commit() error {
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
 func (s *Session) Exec(key string, data interface{}) (sql.Result, error) {
+	return s.ExecContext(context.Background(), key, data)
+}
+
+/// execute the sql with a can ignore result
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) ExecContext(ctx context.Context, key string, data interface{}) (sql.Result, error) {
 	if !s.init {
 		return nil, initError
 	}
 	if s.tx == nil {
-		return exec(key, data, s.db.Exec)
+		return s.engine.exec(s.context(ctx), key, data, s.db.ExecContext)
 	} else {
-		return exec(key, data, s.tx.Exec)
+		return s.engine.exec(s.context(ctx), key, data, s.tx.ExecContext)
 	}
 }
 
@@ -118,13 +141,91 @@ func (s *Session) Exec(key string, data interface{}) (sql.Result, error) {
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
 func (s *Session) Query(key string, data interface{}) ([]map[string]string, error) {
+	return s.QueryContext(context.Background(), key, data)
+}
+
+/// execute the sql and set result to []map[string]string
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryContext(ctx context.Context, key string, data interface{}) ([]map[string]string, error) {
+	if !s.init {
+		return nil, initError
+	}
+	if s.tx == nil {
+		return s.engine.query(s.context(ctx), key, data, s.db.QueryContext)
+	} else {
+		return s.engine.query(s.context(ctx), key, data, s.tx.QueryContext)
+	}
+}
+
+/// execute the sql and set result to []map[string]interface{}, the value is converted
+/// by the column type to int64, float64, bool, time.Time, []byte or string, the NULL is nil
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryMaps(key string, param interface{}) ([]map[string]interface{}, error) {
+	return s.QueryMapsContext(context.Background(), key, param)
+}
+
+/// execute the sql and set result to []map[string]interface{}, the value is converted
+/// by the column type to int64, float64, bool, time.Time, []byte or string, the NULL is nil
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryMapsContext(ctx context.Context, key string, param interface{}) ([]map[string]interface{}, error) {
+	if !s.init {
+		return nil, initError
+	}
+	if s.tx == nil {
+		return s.engine.queryMaps(s.context(ctx), key, param, s.db.QueryContext)
+	} else {
+		return s.engine.queryMaps(s.context(ctx), key, param, s.tx.QueryContext)
+	}
+}
+
+/// execute the sql and set result to []map[string][]byte, the NULL is nil
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryBytes(key string, param interface{}) ([]map[string][]byte, error) {
+	return s.QueryBytesContext(context.Background(), key, param)
+}
+
+/// execute the sql and set result to []map[string][]byte, the NULL is nil
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryBytesContext(ctx context.Context, key string, param interface{}) ([]map[string][]byte, error) {
 	if !s.init {
 		return nil, initError
 	}
 	if s.tx == nil {
-		return query(key, data, s.db.Query)
+		return s.engine.queryBytes(s.context(ctx), key, param, s.db.QueryContext)
 	} else {
-		return query(key, data, s.tx.Query)
+		return s.engine.queryBytes(s.context(ctx), key, param, s.tx.QueryContext)
+	}
+}
+
+/// execute the sql and return the columns and the rows in the column order,
+/// the value is converted like QueryMaps
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryRows(key string, param interface{}) ([]string, [][]interface{}, error) {
+	return s.QueryRowsContext(context.Background(), key, param)
+}
+
+/// execute the sql and return the columns and the rows in the column order,
+/// the value is converted like QueryMaps
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) QueryRowsContext(ctx context.Context, key string, param interface{}) ([]string, [][]interface{}, error) {
+	if !s.init {
+		return nil, nil, initError
+	}
+	if s.tx == nil {
+		return s.engine.querySlice(s.context(ctx), key, param, s.db.QueryContext)
+	} else {
+		return s.engine.querySlice(s.context(ctx), key, param, s.tx.QueryContext)
 	}
 }
 
@@ -133,13 +234,22 @@ func (s *Session) Query(key string, data interface{}) ([]map[string]string, erro
 /// @param key: sql map key, namespace + sql ID
 /// @param param: the param to pass to the sql template
 func (s *Session) Select(dest interface{}, key string, param interface{}) error {
+	return s.SelectContext(context.Background(), dest, key, param)
+}
+
+/// execute sql and set the result to a slice dest
+/// @param ctx: the context of the execution
+/// @param the result will be set to dest, and the dest must be like eg: *[]*struct or *[]struct
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) SelectContext(ctx context.Context, dest interface{}, key string, param interface{}) error {
 	if !s.init {
 		return initError
 	}
 	if s.tx == nil {
-		return selectRows(dest, key, param, s.db.Query)
+		return s.engine.selectRows(s.context(ctx), dest, key, param, s.db.QueryContext)
 	} else {
-		return selectRows(dest, key, param, s.tx.Query)
+		return s.engine.selectRows(s.context(ctx), dest, key, param, s.tx.QueryContext)
 	}
 }
 
@@ -151,12 +261,110 @@ func (s *Session) Select(dest interface{}, key string, param interface{}) error
 /// ERR_NOT_GOT_RECORD indicate that not got any recode from the database
 /// ERR_MORE_THAN_ONE_RECORD indicate that got more than one record from database
 func (s *Session) SelectOne(dest interface{}, key string, param interface{}) error {
+	return s.SelectOneContext(context.Background(), dest, key, param)
+}
+
+/// execute sql and set the result to a struct dest
+/// @param ctx: the context of the execution
+/// @param the result will be set to dest, and the dest must be like eg: *struct
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @return error: ERR_NOT_GOT_RECORD,ERR_MORE_THAN_ONE_RECORD,...
+func (s *Session) SelectOneContext(ctx context.Context, dest interface{}, key string, param interface{}) error {
 	if !s.init {
 		return initError
 	}
 	if s.tx == nil {
-		return selectRow(dest, key, param, s.db.Query)
+		return s.engine.selectRow(s.context(ctx), dest, key, param, s.db.QueryContext)
 	} else {
-		return selectRow(dest, key, param, s.tx.Query)
+		return s.engine.selectRow(s.context(ctx), dest, key, param, s.tx.QueryContext)
+	}
+}
+
+/// execute sql and return the cursor to iterate the result set row by row,
+/// the cursor must be closed after use and before the transaction commit or rollback
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) Iterate(key string, param interface{}) (*Cursor, error) {
+	return s.IterateContext(context.Background(), key, param)
+}
+
+/// execute sql and return the cursor to iterate the result set row by row,
+/// the cursor must be closed after use and before the transaction commit or rollback
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+func (s *Session) IterateContext(ctx context.Context, key string, param interface{}) (*Cursor, error) {
+	if !s.init {
+		return nil, initError
+	}
+	if s.tx == nil {
+		return s.engine.iterate(s.context(ctx), key, param, s.db.QueryContext)
+	} else {
+		return s.engine.iterate(s.context(ctx), key, param, s.tx.QueryContext)
+	}
+}
+
+/// execute sql and call the fn with every row, stop when the fn return error
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param fn: the callback like func(row *T) error, T is the struct, scalar or map[string]interface{}
+func (s *Session) Each(key string, param interface{}, fn interface{}) error {
+	return s.EachContext(context.Background(), key, param, fn)
+}
+
+/// execute sql and call the fn with every row, stop when the fn return error
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param param: the param to pass to the sql template
+/// @param fn: the callback like func(row *T) error, T is the struct, scalar or map[string]interface{}
+func (s *Session) EachContext(ctx context.Context, key string, param interface{}, fn interface{}) error {
+	if !s.init {
+		return initError
+	}
+	if s.tx == nil {
+		return s.engine.each(s.context(ctx), key, param, fn, s.db.QueryContext)
+	} else {
+		return s.engine.each(s.context(ctx), key, param, fn, s.tx.QueryContext)
+	}
+}
+
+/// the context key of the session that execute the sql
+type sessionKey struct{}
+
+/// get the context of the execution in the session, the span of the statement in the transaction is
+/// the child of the transaction span
+/// @param ctx: the context of the execution
+func (s *Session) context(ctx context.Context) context.Context {
+	if s.tx != nil && s.spanCtx != nil {
+		ctx = &txSpanContext{Context: ctx, span: s.spanCtx}
+	}
+	return context.WithValue(ctx, sessionKey{}, s)
+}
+
+/// the context of the statement in the transaction, the values are looked up in the context carry
+/// the transaction span first, so the tracer start the statement span as its child,
+/// the deadline and the cancellation are still of the statement context
+type txSpanContext struct {
+	context.Context
+	span context.Context // the context carry the span of the transaction
+}
+
+/// get the value from the context carry the transaction span, then from the statement context
+func (c *txSpanContext) Value(key interface{}) interface{} {
+	if v := c.span.Value(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+/// get the session in the transaction that execute the sql,
+/// the query not use the cache and the flushed namespaces are flushed again when it commit
+/// @param ctx: the context of the execution
+func txSession(ctx context.Context) *Session {
+	session, ok := ctx.Value(sessionKey{}).(*Session)
+	if !ok || session.tx == nil {
+		return nil
 	}
+	return session
 }
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/beevik/etree"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/// the statement types of the type attribute
+const (
+	StatementSelect = "select"
+	StatementInsert = "insert"
+	StatementUpdate = "update"
+	StatementDelete = "delete"
+)
+
+/// the attributes of the <sql> element that enforced at execution time
+type statementAttrs struct {
+	timeout    time.Duration // the deadline of the execution, 0 for no timeout
+	maxRows    int           // the max rows the query can return, 0 for no limit
+	fetchSize  int           // the hint of the rows the driver fetch per round trip, 0 for the driver default
+	typ        string        // the statement type, empty for unknown
+	readOnly   bool          // the statement can't be executed as a write
+	useCache   bool          // the query results are cached
+	ttl        time.Duration // the expiration of the cached results, 0 for no expiration
+	flushCache bool          // the write flush the cache of the namespace and the dependent namespaces
+	useMaster  bool          // the query is routed to the primary db instead of the replicas
+}
+
+/// parse the cache attributes of the <sqlmap> element as the default of the statements
+/// @param e: the <sqlmap> element
+func parseNamespaceAttrs(e *etree.Element) (statementAttrs, error) {
+	attrs := statementAttrs{}
+	err := attrs.parseCache(e)
+	return attrs, err
+}
+
+/// parse the attributes of the <sql> element
+/// @param e: the <sql> element
+/// @param defaults: the attributes of the <sqlmap> element
+func parseStatementAttrs(e *etree.Element, defaults statementAttrs) (statementAttrs, error) {
+	attrs := statementAttrs{
+		useCache: defaults.useCache,
+		ttl:      defaults.ttl,
+	}
+	err := attrs.parseCache(e)
+	if err != nil {
+		return attrs, err
+	}
+	if v := e.SelectAttrValue("timeout", ""); v != "" {
+		timeout, err := parseTimeout(v)
+		if err != nil || timeout <= 0 {
+			return attrs, errors.New("the timeout " + v + " is invalid")
+		}
+		attrs.timeout = timeout
+	}
+	if v := e.SelectAttrValue("maxRows", ""); v != "" {
+		maxRows, err := strconv.Atoi(v)
+		if err != nil || maxRows <= 0 {
+			return attrs, errors.New("the maxRows " + v + " is invalid")
+		}
+		attrs.maxRows = maxRows
+	}
+	if v := e.SelectAttrValue("fetchSize", ""); v != "" {
+		fetchSize, err := strconv.Atoi(v)
+		if err != nil || fetchSize <= 0 {
+			return attrs, errors.New("the fetchSize " + v + " is invalid")
+		}
+		attrs.fetchSize = fetchSize
+	}
+	if v := e.SelectAttrValue("type", ""); v != "" {
+		typ := strings.ToLower(v)
+		switch typ {
+		case StatementSelect, StatementInsert, StatementUpdate, StatementDelete:
+			attrs.typ = typ
+		default:
+			return attrs, errors.New("the type " + v + " is invalid")
+		}
+	}
+	if v := e.SelectAttrValue("readOnly", ""); v != "" {
+		readOnly, err := strconv.ParseBool(v)
+		if err != nil {
+			return attrs, errors.New("the readOnly " + v + " is invalid")
+		}
+		attrs.readOnly = readOnly
+	}
+	if v := e.SelectAttrValue("flushCache", ""); v != "" {
+		flushCache, err := strconv.ParseBool(v)
+		if err != nil {
+			return attrs, errors.New("the flushCache " + v + " is invalid")
+		}
+		attrs.flushCache = flushCache
+	}
+	if v := e.SelectAttrValue("useMaster", ""); v != "" {
+		useMaster, err := strconv.ParseBool(v)
+		if err != nil {
+			return attrs, errors.New("the useMaster " + v + " is invalid")
+		}
+		attrs.useMaster = useMaster
+	}
+	if attrs.readOnly && attrs.isWrite() {
+		return attrs, errors.New("the " + attrs.typ + " statement can't be readOnly")
+	}
+	if attrs.isWrite() {
+		attrs.useCache = false
+	}
+	return attrs, nil
+}
+
+/// parse the useCache and ttl attributes
+/// @param e: the <sqlmap> or <sql> element
+func (a *statementAttrs) parseCache(e *etree.Element) error {
+	if v := e.SelectAttrValue("useCache", ""); v != "" {
+		useCache, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("the useCache " + v + " is invalid")
+		}
+		a.useCache = useCache
+	}
+	if v := e.SelectAttrValue("ttl", ""); v != "" {
+		ttl, err := parseTimeout(v)
+		if err != nil || ttl < 0 {
+			return errors.New("the ttl " + v + " is invalid")
+		}
+		a.ttl = ttl
+	}
+	return nil
+}
+
+/// parse the duration like 2s, 500ms, or the seconds like 2
+func parseTimeout(v string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+/// check if the statement is declared as a write
+func (a statementAttrs) isWrite() bool {
+	return a.typ == StatementInsert || a.typ == StatementUpdate || a.typ == StatementDelete
+}
+
+/// check the statement can be executed as a query
+func (a statementAttrs) checkQuery() error {
+	if a.isWrite() {
+		return ERR_NOT_QUERY_STATEMENT
+	}
+	return nil
+}
+
+/// check the statement can be executed as a write
+func (a statementAttrs) checkExec() error {
+	if a.typ == StatementSelect || a.readOnly {
+		return ERR_NOT_EXEC_STATEMENT
+	}
+	return nil
+}
+
+/// derive the context with the timeout of the statement
+/// @param ctx: the context of the execution
+func (a statementAttrs) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, a.timeout)
+}
+
+/// check the count of the rows read not exceed the maxRows
+/// @param count: the count of the rows read
+/// @param maxRows: the max rows the query can return, 0 for no limit
+func checkMaxRows(count, maxRows int) error {
+	if maxRows > 0 && count > maxRows {
+		return ERR_TOO_MANY_ROWS
+	}
+	return nil
+}
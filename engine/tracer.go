@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"strings"
+)
+
+/// the key/value attribute of the span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+/// create an attribute
+/// @param key: the attribute key
+/// @param value: the attribute value
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+/// the span of the statement execution or the transaction
+type Span interface {
+	/// add the attributes to the span
+	SetAttributes(attrs ...Attribute)
+	/// end the span, err is nil if it succeed
+	End(err error)
+}
+
+/// the tracer that the engine start the span for every statement and transaction with,
+/// adapt it to the tracing library like OpenTelemetry
+type Tracer interface {
+	/// start the span as the child of the span in the ctx, return the ctx carry the new span
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+	/// get the trace ID of the span in the ctx, empty if there is no span
+	TraceID(ctx context.Context) string
+}
+
+/// the span names
+const (
+	SpanQuery       = "sqlmap.query"
+	SpanExec        = "sqlmap.exec"
+	SpanTransaction = "sqlmap.transaction"
+)
+
+/// set the tracer of the statement execution and the transaction
+/// @param t: the tracer, nil to disable the tracing
+func (s *SqlEngine) SetTracer(t Tracer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tracer = t
+}
+
+/// set whether to append the comment like /* key=my.selectOne, trace_id=... */ to the executed sql,
+/// the trace_id is omitted if there is no tracer or no span
+/// @param enable: true to append the comment
+func (s *SqlEngine) SetSqlComment(enable bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sqlComment = enable
+}
+
+/// get the tracer and whether to append the sql comment
+func (s *SqlEngine) getTracer() (Tracer, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tracer, s.sqlComment
+}
+
+/// start the span if the tracer is set
+/// @param ctx: the context of the execution
+/// @param name: the span name
+/// @param attrs: the attributes of the span
+func (s *SqlEngine) startSpan(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	tracer, _ := s.getTracer()
+	if tracer == nil {
+		return ctx, nil
+	}
+	return tracer.Start(ctx, name, attrs...)
+}
+
+/// start the span of the statement execution
+/// @param ctx: the context of the execution
+/// @param inv: the invocation of the sql
+func (s *SqlEngine) startStatementSpan(ctx context.Context, inv *Invocation) context.Context {
+	name := SpanQuery
+	if inv.Operation == OperationExec {
+		name = SpanExec
+	}
+	ctx, inv.span = s.startSpan(ctx, name,
+		Attr("db.statement.key", inv.Key),
+		Attr("db.statement", inv.SQL),
+		Attr("db.operation", inv.Operation.String()),
+	)
+	return ctx
+}
+
+/// end the span if it is started
+/// @param span: the span, nil if the tracer is not set
+/// @param err: the error of the execution
+/// @param attrs: the attributes to add before end
+func endSpan(span Span, err error, attrs ...Attribute) {
+	if span == nil {
+		return
+	}
+	if len(attrs) > 0 {
+		span.SetAttributes(attrs...)
+	}
+	span.End(err)
+}
+
+/// append the comment with the sql key and the trace ID to the sql if it is enabled
+/// @param ctx: the context of the execution
+/// @param key: sql map key, namespace + sql ID
+/// @param sqlStr: the sql to execute
+func (s *SqlEngine) comment(ctx context.Context, key, sqlStr string) string {
+	tracer, sqlComment := s.getTracer()
+	if !sqlComment {
+		return sqlStr
+	}
+	c := "key=" + escapeComment(key)
+	if tracer != nil {
+		if id := tracer.TraceID(ctx); id != "" {
+			c += ", trace_id=" + escapeComment(id)
+		}
+	}
+	return sqlStr + " /* " + c + " */"
+}
+
+/// escape the value can't be in the sql comment
+func escapeComment(v string) string {
+	v = strings.Replace(v, "*/", "* /", -1)
+	return strings.Replace(v, "/*", "/ *", -1)
+}
@@ -0,0 +1,320 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"github.com/zhaobingss/sqlmap/log"
+	"strconv"
+)
+
+/// the propagation of the transaction scope, decide how to begin when the transaction is already begun
+type Propagation int
+
+const (
+	PropagationRequired    Propagation = iota // join the transaction, or begin a new one if not begun
+	PropagationRequiresNew                    // suspend the transaction and begin a new one on another connection
+	PropagationNested                         // create a savepoint in the transaction, or begin a new one if not begun
+	PropagationNever                          // execute without transaction, return ERR_TX_EXISTS if it is begun
+)
+
+/// get the name of the propagation
+func (p Propagation) String() string {
+	switch p {
+	case PropagationRequired:
+		return "REQUIRED"
+	case PropagationRequiresNew:
+		return "REQUIRES_NEW"
+	case PropagationNested:
+		return "NESTED"
+	case PropagationNever:
+		return "NEVER"
+	}
+	return "UNKNOWN"
+}
+
+/// the transaction scope begun by the session
+type txFrame struct {
+	propagation Propagation
+	owner       bool     // the scope began the transaction, it commit or rollback the transaction
+	savepoint   string   // the savepoint created by the nested scope
+	suspended   *txState // the transaction suspended by the requires new scope
+	ended       bool     // the scope is committed, Commit and Rollback skip it
+}
+
+/// the transaction suspended by the requires new scope, it is resumed when the scope end
+type txState struct {
+	tx           *sql.Tx
+	savepoints   int
+	rollbackOnly bool
+	txCache      *txCache
+	span         Span
+	spanCtx      context.Context
+}
+
+/// begin a transaction scope with the propagation, end it by Commit or Rollback
+/// @param ctx: the context of the transaction, the transaction will be rollback if the ctx is done
+/// @param opts: the transaction options, nil for the default, ignored if the transaction is joined
+/// @param p: the propagation of the scope
+func (s *Session) BeginTxPropagation(ctx context.Context, opts *sql.TxOptions, p Propagation) error {
+	if !s.init {
+		return initError
+	}
+	active := s.tx != nil
+	frame := &txFrame{propagation: p}
+	switch {
+	case p == PropagationNever:
+		if active {
+			return ERR_TX_EXISTS
+		}
+	case p == PropagationRequired && active:
+	case p == PropagationNested && active:
+		s.savepoints++
+		name := "sqlmap_sp_" + strconv.Itoa(s.savepoints)
+		err := s.savepoint(ctx, name)
+		if err != nil {
+			return err
+		}
+		frame.savepoint = name
+	default:
+		if active {
+			frame.suspended = s.suspend()
+		}
+		err := s.begin(ctx, opts)
+		if err != nil {
+			s.resume(frame.suspended)
+			return err
+		}
+		frame.owner = true
+	}
+	s.frames = append(s.frames, frame)
+	return nil
+}
+
+/// mark the transaction as rollback-only, the commit of the scope began it will rollback and return ERR_ROLLBACK_ONLY
+func (s *Session) SetRollbackOnly() error {
+	if !s.init {
+		return initError
+	}
+	if s.tx == nil {
+		return ERR_NO_TX
+	}
+	s.rollbackOnly = true
+	return nil
+}
+
+/// check if the transaction is marked as rollback-only
+func (s *Session) IsRollbackOnly() bool {
+	return s.tx != nil && s.rollbackOnly
+}
+
+/// run f in the transaction scope with the propagation, the scope is rollback if f return error or panic,
+/// the panic is raised again after the rollback
+/// @param p: the propagation of the scope
+/// @param f：the function that the transaction code will be run
+func (s *Session) Transaction(p Propagation, f func(s *Session) (interface{}, error)) (interface{}, error) {
+	return s.TransactionTx(context.Background(), nil, p, f)
+}
+
+/// run f in the transaction scope with the propagation, the scope is rollback if f return error or panic,
+/// the panic is raised again after the rollback
+/// @param ctx: the context of the transaction
+/// @param opts: the transaction options, nil for the default, ignored if the transaction is joined
+/// @param p: the propagation of the scope
+/// @param f：the function that the transaction code will be run
+/// @return error: the error of f, or *RollbackError if the rollback also fail
+func (s *Session) TransactionTx(ctx context.Context, opts *sql.TxOptions, p Propagation, f func(s *Session) (interface{}, error)) (interface{}, error) {
+	err := s.BeginTxPropagation(ctx, opts, p)
+	if err != nil {
+		return nil, err
+	}
+	frame := s.frames[len(s.frames)-1]
+	defer func() {
+		if r := recover(); r != nil {
+			if err := s.endScope(frame, false); err != nil {
+				s.engine.getLogger().Log(ctx, log.LevelError, "rollback after panic fail", log.F("error", err))
+			}
+			panic(r)
+		}
+	}()
+	result, err := f(s)
+	if err != nil {
+		if rbErr := s.endScope(frame, false); rbErr != nil {
+			return nil, &RollbackError{Err: err, RollbackErr: rbErr}
+		}
+		return nil, err
+	}
+
+	err = s.endScope(frame, true)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+/// end the scope, the scopes inside it that f not end are rollback first,
+/// the scope is rollback instead of commit if they fail to rollback
+/// @param frame: the scope to end
+/// @param commit: commit or rollback the scope
+func (s *Session) endScope(frame *txFrame, commit bool) error {
+	index := -1
+	for i, f := range s.frames {
+		if f == frame {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	var innerErr error
+	for len(s.frames) > index+1 {
+		inner := s.frames[len(s.frames)-1]
+		s.frames = s.frames[:len(s.frames)-1]
+		if inner.ended {
+			continue
+		}
+		if err := s.rollback(inner); err != nil && innerErr == nil {
+			innerErr = err
+		}
+	}
+	s.frames = s.frames[:index]
+	defer s.clearEnded()
+	if frame.ended {
+		// f committed the scope itself
+		return innerErr
+	}
+	if innerErr != nil {
+		if err := s.rollback(frame); err != nil {
+			return &RollbackError{Err: innerErr, RollbackErr: err}
+		}
+		return innerErr
+	}
+	if commit {
+		return s.commit(frame)
+	}
+	return s.rollback(frame)
+}
+
+/// remove the committed scopes if all the scopes are ended
+func (s *Session) clearEnded() {
+	for _, f := range s.frames {
+		if !f.ended {
+			return
+		}
+	}
+	s.frames = nil
+}
+
+/// begin the transaction on a connection of the db
+func (s *Session) begin(ctx context.Context, opts *sql.TxOptions) error {
+	ctx, span := s.engine.startSpan(ctx, SpanTransaction)
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		endSpan(span, err)
+		return err
+	}
+
+	s.tx = tx
+	s.span = span
+	if span != nil {
+		s.spanCtx = ctx
+	}
+	s.savepoints = 0
+	s.rollbackOnly = false
+	s.txCache = &txCache{namespaces: map[string]bool{}}
+	return nil
+}
+
+/// commit the scope, the transaction is committed if the scope began it
+/// @param frame: the scope, the scopes inside it must be ended
+func (s *Session) commit(frame *txFrame) error {
+	if frame.savepoint != "" {
+		return s.releaseSavepoint(context.Background(), frame.savepoint)
+	}
+	if !frame.owner {
+		return nil
+	}
+
+	if s.rollbackOnly {
+		err := s.tx.Rollback()
+		endSpan(s.span, ERR_ROLLBACK_ONLY, Attr("db.transaction", "rollback"))
+		s.end(frame)
+		if err != nil {
+			return &RollbackError{Err: ERR_ROLLBACK_ONLY, RollbackErr: err}
+		}
+		return ERR_ROLLBACK_ONLY
+	}
+
+	err := s.tx.Commit()
+	endSpan(s.span, err, Attr("db.transaction", "commit"))
+	namespaces := s.txCache.list()
+	s.end(frame)
+	if err != nil {
+		return err
+	}
+	// flush again to drop the results cached by others before the commit
+	s.engine.flushNamespaces(namespaces)
+	return nil
+}
+
+/// rollback the scope, the transaction is rollback if the scope began it,
+/// or rollback to the savepoint if the scope is nested, or marked as rollback-only if the scope joined it
+/// @param frame: the scope, the scopes inside it must be ended
+func (s *Session) rollback(frame *txFrame) error {
+	if frame.savepoint != "" {
+		return s.rollbackToSavepoint(context.Background(), frame.savepoint)
+	}
+	if frame.owner {
+		err := s.tx.Rollback()
+		endSpan(s.span, err, Attr("db.transaction", "rollback"))
+		s.end(frame)
+		return err
+	}
+	if frame.propagation == PropagationRequired {
+		s.rollbackOnly = true
+	}
+	return nil
+}
+
+/// clear the ended transaction and resume the one suspended by the scope
+func (s *Session) end(frame *txFrame) {
+	s.tx = nil
+	s.span = nil
+	s.spanCtx = nil
+	s.savepoints = 0
+	s.rollbackOnly = false
+	s.txCache = nil
+	s.resume(frame.suspended)
+}
+
+/// suspend the transaction
+func (s *Session) suspend() *txState {
+	state := &txState{
+		tx:           s.tx,
+		savepoints:   s.savepoints,
+		rollbackOnly: s.rollbackOnly,
+		txCache:      s.txCache,
+		span:         s.span,
+		spanCtx:      s.spanCtx,
+	}
+	s.tx = nil
+	s.span = nil
+	s.spanCtx = nil
+	s.savepoints = 0
+	s.rollbackOnly = false
+	s.txCache = nil
+	return state
+}
+
+/// resume the suspended transaction
+/// @param state: the suspended transaction, nil for nothing
+func (s *Session) resume(state *txState) {
+	if state == nil {
+		return
+	}
+	s.tx = state.tx
+	s.savepoints = state.savepoints
+	s.rollbackOnly = state.rollbackOnly
+	s.txCache = state.txCache
+	s.span = state.span
+	s.spanCtx = state.spanCtx
+}
@@ -1,6 +1,6 @@
 module github.com/zhaobingss/sqlmap
 
-go 1.11
+go 1.16
 
 require (
 	github.com/beevik/etree v1.1.0
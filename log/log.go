@@ -1,10 +1,94 @@
 package log
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 var Info = printInfo
 var Error = printError
 
+/// the level of the log
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+/// get the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+/// the key/value field of the log
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+/// create a field
+/// @param key: the field key
+/// @param value: the field value
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+/// the leveled logger with the key/value fields
+type Logger interface {
+	/// check if the level is enabled, the fields are not built if it is disabled
+	Enabled(level Level) bool
+	/// log the message with the fields
+	Log(ctx context.Context, level Level, msg string, fields ...Field)
+}
+
+/// the logger that write the log by the Info and Error func
+type funcLogger struct{}
+
+/// get the default logger that write the debug and info log by the Info func,
+/// and the warn and error log by the Error func, the debug log is disabled
+func Default() Logger {
+	return funcLogger{}
+}
+
+/// check if the level is enabled
+func (funcLogger) Enabled(level Level) bool {
+	if level >= LevelWarn {
+		return Error != nil
+	}
+	return level >= LevelInfo && Info != nil
+}
+
+/// log the message with the fields as key=value
+func (l funcLogger) Log(ctx context.Context, level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	v := make([]interface{}, 0, len(fields))
+	for _, f := range fields {
+		v = append(v, fmt.Sprintf("%s=%v", f.Key, f.Value))
+	}
+	if level == LevelWarn {
+		Error("WARN "+msg, v...)
+	} else if level == LevelError {
+		Error(msg, v...)
+	} else {
+		Info(msg, v...)
+	}
+}
+
 /// the default info log func
 func printInfo(f interface{}, v ...interface{}) {
 	fmt.Println("INF: ", f, v)
@@ -0,0 +1,53 @@
+//go:build go1.21
+// +build go1.21
+
+package log
+
+import (
+	"context"
+	"log/slog"
+)
+
+/// the logger that write the log by the log/slog logger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+/// create the logger that write the log by the log/slog logger
+/// @param logger: the slog logger, nil for the slog default logger
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogLogger{logger: logger}
+}
+
+/// check if the level is enabled
+func (l *slogLogger) Enabled(level Level) bool {
+	return l.logger.Enabled(context.Background(), slogLevel(level))
+}
+
+/// log the message with the fields as the attrs
+func (l *slogLogger) Log(ctx context.Context, level Level, msg string, fields ...Field) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, f := range fields {
+		attrs = append(attrs, slog.Any(f.Key, f.Value))
+	}
+	l.logger.LogAttrs(ctx, slogLevel(level), msg, attrs...)
+}
+
+/// convert the level to the slog level
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,182 @@
+package test
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+)
+
+/// the fake driver that record the sql executed on every dsn, the query return one row
+/// with the column dsn, use to assert the sql, the calls and the routing without database
+type recordDriver struct {
+	lock    sync.Mutex
+	queries map[string][]string         // the executed sql by the dsn
+	args    map[string][][]driver.Value // the args of the executed sql by the dsn
+	events  map[string][]string         // the sql and the transaction events with the connection ID by the dsn, eg: 1 BEGIN
+	conns   map[string]int              // the count of the connections opened by the dsn
+	down    map[string]bool             // the dsn that fail the ping
+	types   map[string]string           // the database type name of the column dsn by the dsn
+}
+
+var recorder = &recordDriver{
+	queries: map[string][]string{},
+	args:    map[string][][]driver.Value{},
+	events:  map[string][]string{},
+	conns:   map[string]int{},
+	down:    map[string]bool{},
+	types:   map[string]string{},
+}
+
+func init() {
+	sql.Register("recorder", recorder)
+}
+
+/// get the sql executed on the dsn
+func (d *recordDriver) Queries(dsn string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.queries[dsn]...)
+}
+
+/// get the args of the sql executed on the dsn
+func (d *recordDriver) Args(dsn string) [][]driver.Value {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([][]driver.Value{}, d.args[dsn]...)
+}
+
+/// get the sql and the transaction events with the connection ID of the dsn
+func (d *recordDriver) Events(dsn string) []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.events[dsn]...)
+}
+
+/// set whether the ping of the dsn fail
+func (d *recordDriver) SetDown(dsn string, down bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.down[dsn] = down
+}
+
+/// set the database type name of the column dsn returned by the dsn
+func (d *recordDriver) SetType(dsn, typ string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.types[dsn] = typ
+}
+
+func (d *recordDriver) record(c *recordConn, query string, args []driver.Value) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.queries[c.dsn] = append(d.queries[c.dsn], query)
+	d.args[c.dsn] = append(d.args[c.dsn], append([]driver.Value{}, args...))
+	d.events[c.dsn] = append(d.events[c.dsn], strconv.Itoa(c.id)+" "+query)
+}
+
+func (d *recordDriver) event(c *recordConn, event string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.events[c.dsn] = append(d.events[c.dsn], strconv.Itoa(c.id)+" "+event)
+}
+
+func (d *recordDriver) Open(dsn string) (driver.Conn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.conns[dsn]++
+	return &recordConn{driver: d, dsn: dsn, id: d.conns[dsn]}, nil
+}
+
+type recordConn struct {
+	driver *recordDriver
+	dsn    string
+	id     int
+}
+
+func (c *recordConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordStmt{conn: c, query: query}, nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+func (c *recordConn) Begin() (driver.Tx, error) {
+	c.driver.event(c, "BEGIN")
+	return c, nil
+}
+
+func (c *recordConn) Commit() error {
+	c.driver.event(c, "COMMIT")
+	return nil
+}
+
+func (c *recordConn) Rollback() error {
+	c.driver.event(c, "ROLLBACK")
+	return nil
+}
+
+func (c *recordConn) Ping(ctx context.Context) error {
+	c.driver.lock.Lock()
+	defer c.driver.lock.Unlock()
+	if c.driver.down[c.dsn] {
+		return errors.New(c.dsn + " is down")
+	}
+	return nil
+}
+
+type recordStmt struct {
+	conn  *recordConn
+	query string
+}
+
+func (s *recordStmt) Close() error {
+	return nil
+}
+
+func (s *recordStmt) NumInput() int {
+	return -1
+}
+
+func (s *recordStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.driver.record(s.conn, s.query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.driver.record(s.conn, s.query, args)
+	s.conn.driver.lock.Lock()
+	defer s.conn.driver.lock.Unlock()
+	return &recordRows{dsn: s.conn.dsn, typ: s.conn.driver.types[s.conn.dsn]}, nil
+}
+
+type recordRows struct {
+	dsn  string
+	typ  string
+	done bool
+}
+
+func (r *recordRows) Columns() []string {
+	return []string{"dsn"}
+}
+
+func (r *recordRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.typ
+}
+
+func (r *recordRows) Close() error {
+	return nil
+}
+
+func (r *recordRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.dsn
+	return nil
+}
@@ -1,12 +1,24 @@
 package test
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/zhaobingss/sqlmap/engine"
+	"github.com/zhaobingss/sqlmap/log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 type Resource struct {
@@ -22,6 +34,14 @@ type Resource struct {
 	CreateTime  string         `db:"create_time"`
 	UpdateTime  string         `db:"update_time"`
 }
+
+type ResourceTree struct {
+	ID       int    `db:"id"`
+	Name     string `db:"name"`
+	Parent   *ResourceTree
+	Children []*ResourceTree
+}
+
 var eg *engine.SqlEngine
 var wg sync.WaitGroup
 func init() {
@@ -54,6 +74,544 @@ func TestStruct_test(t *testing.T) {
 	fmt.Println(src)
 }
 
+func TestBindParam_test(t *testing.T) {
+	src := Resource{}
+	err := eg.SelectOne(&src, "my.selectByCode", map[string]string{"Code": "' OR '1'='1"})
+	if err != engine.ERR_NOT_GOT_RECORD {
+		t.Fatal(err)
+	}
+}
+
+func TestParamInjection_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "param", map[string][]byte{
+		"param.goxml": []byte(`<sqlmap namespace="param">
+			<sql id="echo">SELECT '{{.Text}}' AS text, #{Code} AS code</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the param in the text printed by the template is not bound
+	_, err = e.Query("param.echo", map[string]string{"Text": "${Code} #{Code}", "Code": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := recorder.Queries("param")
+	if len(queries) != 1 || queries[0] != "SELECT '${Code} #{Code}' AS text, ? AS code" {
+		t.Fatal(queries)
+	}
+	// the text printed by the template can't forge the param mark without the nonce
+	_, err = e.Query("param.echo", map[string]string{"Text": "\x01$Secret\x02\x01#Secret\x02", "Code": "x", "Secret": "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries = recorder.Queries("param")
+	if len(queries) != 2 || queries[1] != "SELECT '\x01$Secret\x02\x01#Secret\x02' AS text, ? AS code" {
+		t.Fatalf("%q", queries)
+	}
+	args := recorder.Args("param")
+	if len(args) != 2 || len(args[0]) != 1 || args[0][0] != "x" || len(args[1]) != 1 || args[1][0] != "x" {
+		t.Fatal(args)
+	}
+	_, err = e.Query("param.echo", map[string]string{"Text": "x"})
+	if err == nil || !strings.Contains(err.Error(), "has no key Code") {
+		t.Fatal(err)
+	}
+}
+
+func TestDialect_test(t *testing.T) {
+	files := map[string][]byte{
+		"dialect.goxml": []byte(`<sqlmap namespace="dialect">
+			<sql id="select">SELECT * FROM t WHERE a = #{A} AND b = #{B}</sql>
+		</sqlmap>`),
+	}
+	cases := map[string]engine.Dialect{
+		"SELECT * FROM t WHERE a = ? AND b = ?":     engine.MySQL,
+		"SELECT * FROM t WHERE a = $1 AND b = $2":   engine.Postgres,
+		"SELECT * FROM t WHERE a = :1 AND b = :2":   engine.Oracle,
+		"SELECT * FROM t WHERE a = @p1 AND b = @p2": engine.SQLServer,
+	}
+	for want, d := range cases {
+		dsn := "dialect-" + d.Name()
+		e := engine.New()
+		e.SetDialect(d)
+		err := e.InitBytes("recorder", dsn, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = e.Query("dialect.select", map[string]int{"A": 1, "B": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries := recorder.Queries(dsn)
+		if len(queries) != 1 || queries[0] != want {
+			t.Fatal(d.Name(), queries)
+		}
+	}
+}
+
+func TestContextCancel_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "cancel", map[string][]byte{
+		"cancel.goxml": []byte(`<sqlmap namespace="cancel">
+			<sql id="select">SELECT * FROM t</sql>
+			<sql id="update">UPDATE t SET a = 1</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = e.QueryContext(ctx, "cancel.select", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	_, err = e.ExecuteContext(ctx, "cancel.update", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	_, err = e.NewSession().QueryContext(ctx, "cancel.select", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal(err)
+	}
+	if queries := recorder.Queries("cancel"); len(queries) != 0 {
+		t.Fatal(queries)
+	}
+	_, err = e.QueryContext(context.Background(), "cancel.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInclude_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "include", map[string][]byte{
+		"common.goxml": []byte(`<sqlmap namespace="common">
+			<fragment id="cols">${alias}.id, ${alias}.name</fragment>
+		</sqlmap>`),
+		"include.goxml": []byte(`<sqlmap namespace="include">
+			<fragment id="byName">WHERE ${alias}.name = #{Name}</fragment>
+			<sql id="select">
+				SELECT <include refid="common.cols"><property name="alias" value="s"/></include> FROM sys_src s
+				<include refid="byName"><property name="alias" value="s"/></include>
+			</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("include.select", map[string]string{"Name": "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := recorder.Queries("include")
+	if len(queries) != 1 || queries[0] != "SELECT s.id, s.name FROM sys_src s WHERE s.name = ?" {
+		t.Fatal(queries)
+	}
+
+	_, err = engine.NewEngineBytes("recorder", "include", map[string][]byte{
+		"cycle.goxml": []byte(`<sqlmap namespace="cycle">
+			<fragment id="a"><include refid="b"/></fragment>
+			<fragment id="b"><include refid="a"/></fragment>
+			<sql id="select">SELECT <include refid="a"/></sql>
+		</sqlmap>`),
+	})
+	if err == nil || !strings.Contains(err.Error(), "cyclic") {
+		t.Fatal(err)
+	}
+}
+
+func TestEngineIsolation_test(t *testing.T) {
+	a, err := engine.NewEngineBytes("recorder", "isolation-a", map[string][]byte{
+		"iso.goxml": []byte(`<sqlmap namespace="iso">
+			<sql id="select">SELECT a FROM t</sql>
+			<sql id="onlyA">SELECT 1</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := engine.NewEngineBytes("recorder", "isolation-b", map[string][]byte{
+		"iso.goxml": []byte(`<sqlmap namespace="iso"><sql id="select">SELECT b FROM t</sql></sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Query("iso.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &engine.Session{}
+	session.InitEngine(b)
+	_, err = session.Query("iso.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qa, qb := recorder.Queries("isolation-a"), recorder.Queries("isolation-b"); len(qa) != 1 || qa[0] != "SELECT a FROM t" || len(qb) != 1 || qb[0] != "SELECT b FROM t" {
+		t.Fatal(qa, qb)
+	}
+	_, err = b.Query("iso.onlyA", nil)
+	if err == nil {
+		t.Fatal("the statement of the other engine must not be found")
+	}
+}
+
+func TestDynamic_test(t *testing.T) {
+	srcs := make([]*Resource, 0)
+	err := eg.Select(&srcs, "my.selectByCondition", &Resource{Pid: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range srcs {
+		if v.Pid != 1 {
+			t.Fatal(v)
+		}
+	}
+}
+
+func TestDynamicElements_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "dynamic", map[string][]byte{
+		"dynamic.goxml": []byte(`<sqlmap namespace="dynamic">
+			<sql id="set">
+				UPDATE t
+				<set>
+					<if test=".Name">name = #{Name},</if>
+					<if test=".Code">code = #{Code},</if>
+				</set>
+				WHERE id = #{Id}
+			</sql>
+			<sql id="trim">
+				SELECT * FROM t
+				<trim prefix="WHERE (" suffix=")" prefixOverrides="AND |OR " suffixOverrides=" AND| OR">
+					<if test=".A">or a = #{A}</if>
+					<if test=".B">AND b = #{B} AND</if>
+				</trim>
+			</sql>
+			<sql id="choose">
+				SELECT * FROM t WHERE
+				<choose>
+					<when test=".Id">id = #{Id}</when>
+					<when test=".Name">name = #{Name}</when>
+					<otherwise>1 = 0</otherwise>
+				</choose>
+			</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key   string
+		param map[string]interface{}
+		sql   string
+		args  string
+	}{
+		{"dynamic.set", map[string]interface{}{"Name": "n", "Code": "c", "Id": 1}, "UPDATE t SET name = ?, code = ? WHERE id = ?", "[n c 1]"},
+		{"dynamic.set", map[string]interface{}{"Code": "c", "Id": 1}, "UPDATE t SET code = ? WHERE id = ?", "[c 1]"},
+		{"dynamic.trim", map[string]interface{}{"A": 1, "B": 2}, "SELECT * FROM t WHERE ( a = ? AND b = ? )", "[1 2]"},
+		{"dynamic.trim", map[string]interface{}{"B": 2}, "SELECT * FROM t WHERE ( b = ? )", "[2]"},
+		{"dynamic.trim", map[string]interface{}{}, "SELECT * FROM t", "[]"},
+		{"dynamic.choose", map[string]interface{}{"Id": 1, "Name": "n"}, "SELECT * FROM t WHERE id = ?", "[1]"},
+		{"dynamic.choose", map[string]interface{}{"Name": "n"}, "SELECT * FROM t WHERE name = ?", "[n]"},
+		{"dynamic.choose", map[string]interface{}{}, "SELECT * FROM t WHERE 1 = 0", "[]"},
+	}
+	for i, c := range cases {
+		_, err = e.Execute(c.key, c.param)
+		if err != nil {
+			t.Fatal(c.key, err)
+		}
+		queries, args := recorder.Queries("dynamic"), recorder.Args("dynamic")
+		if len(queries) != i+1 || queries[i] != c.sql || fmt.Sprint(args[i]) != c.args {
+			t.Fatal(c.key, c.param, queries, args)
+		}
+	}
+}
+
+func TestForeach_test(t *testing.T) {
+	srcs := make([]*Resource, 0)
+	err := eg.Select(&srcs, "my.selectByIds", map[string][]int{"ids": {1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = eg.Select(&srcs, "my.selectByIds", map[string][]int{"ids": {}})
+	if err == nil {
+		t.Fatal("the empty collection must be error")
+	}
+}
+
+type SrcDto struct {
+	Key   int64
+	Title string
+	Pid   int `db:"pid"`
+	Audit *struct {
+		UpdatedAt string
+	}
+}
+
+func TestForeachCollection_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "foreach", map[string][]byte{
+		"foreach.goxml": []byte(`<sqlmap namespace="foreach">
+			<sql id="map">SELECT * FROM t WHERE id IN <foreach collection="M" item="v" open="(" close=")" separator=",">#{v}</foreach></sql>
+			<sql id="field">SELECT * FROM t WHERE name IN <foreach collection="Users" item="u" open="(" close=")" separator=",">#{u.Name}</foreach></sql>
+			<sql id="null">SELECT * FROM t WHERE id IN <foreach collection="Ids" item="id" open="(" close=")" separator="," empty="null">#{id}</foreach></sql>
+			<sql id="skip">SELECT * FROM t WHERE a = 1<foreach collection="Ids" item="id" open=" AND id IN (" close=")" separator="," empty="skip">#{id}</foreach></sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the map key with dot is bound as a whole key
+	_, err = e.Query("foreach.map", map[string]interface{}{"M": map[string]int{"x": 1, "y.z": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("foreach.field", map[string]interface{}{"Users": map[string]map[string]string{"a.b": {"Name": "n1"}, "c": {"Name": "n2"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("foreach.null", map[string]interface{}{"Ids": []int{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("foreach.skip", map[string]interface{}{"Ids": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("foreach.skip", map[string]interface{}{"Ids": []int{3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"SELECT * FROM t WHERE id IN (?,?)",
+		"SELECT * FROM t WHERE name IN (?,?)",
+		"SELECT * FROM t WHERE id IN (NULL)",
+		"SELECT * FROM t WHERE a = 1",
+		"SELECT * FROM t WHERE a = 1 AND id IN (?)",
+	}
+	queries := recorder.Queries("foreach")
+	if strings.Join(queries, "\n") != strings.Join(want, "\n") {
+		t.Fatal(queries)
+	}
+	args := fmt.Sprint(recorder.Args("foreach"))
+	if args != "[[1 2] [n1 n2] [] [] [3]]" {
+		t.Fatal(args)
+	}
+}
+
+func TestResultMap_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "resultMap", map[string][]byte{
+		"dto.goxml": []byte(`<sqlmap namespace="dto">
+			<resultMap id="srcDto">
+				<id column="id" property="Key"/>
+				<result column="name" property="Title"/>
+				<result column="update_time" property="Audit.UpdatedAt"/>
+			</resultMap>
+			<sql id="select" resultMap="srcDto">SELECT * FROM sys_src</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.RegisterInterceptor(engine.InterceptorFunc(func(ctx context.Context, inv *engine.Invocation, next engine.Invoker) error {
+		return inv.SetRows([]string{"id", "pid", "name", "update_time"}, [][]interface{}{
+			{int64(1), int64(0), "a", "2020-01-01"},
+			{int64(2), int64(1), "b", "2020-01-02"},
+		})
+	}))
+	dtos := make([]*SrcDto, 0)
+	err = e.Select(&dtos, "dto.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dtos) != 2 || dtos[1].Key != 2 || dtos[1].Title != "b" || dtos[1].Pid != 1 || dtos[1].Audit.UpdatedAt != "2020-01-02" {
+		t.Fatal(dtos)
+	}
+}
+
+func TestNestedResult_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "nested", map[string][]byte{
+		"nested.goxml": []byte(`<sqlmap namespace="nested">
+			<resultMap id="tree">
+				<id column="id" property="ID"/>
+				<result column="name" property="Name"/>
+				<association property="Parent" columnPrefix="p_">
+					<id column="id" property="ID"/>
+					<result column="name" property="Name"/>
+				</association>
+				<collection property="Children" columnPrefix="c_">
+					<id column="id" property="ID"/>
+					<result column="name" property="Name"/>
+				</collection>
+			</resultMap>
+			<sql id="select" resultMap="tree">
+				SELECT s.id, s.name, p.id p_id, p.name p_name, c.id c_id, c.name c_name FROM sys_src s
+				LEFT JOIN sys_src p ON p.id = s.pid LEFT JOIN sys_src c ON c.pid = s.id
+			</sql>
+			<sql id="selectOne" resultMap="tree">
+				SELECT s.id, s.name, p.id p_id, p.name p_name, c.id c_id, c.name c_name FROM sys_src s
+				LEFT JOIN sys_src p ON p.id = s.pid LEFT JOIN sys_src c ON c.pid = s.id WHERE s.id = #{ID}
+			</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []string{"id", "name", "p_id", "p_name", "c_id", "c_name"}
+	rows := [][]interface{}{
+		{int64(1), "a", nil, nil, int64(2), "b"},
+		{int64(1), "a", nil, nil, int64(3), "c"},
+		{int64(2), "b", int64(1), "a", nil, nil},
+		{int64(4), "d", nil, nil, nil, nil},
+	}
+	e.RegisterInterceptor(engine.InterceptorFunc(func(ctx context.Context, inv *engine.Invocation, next engine.Invoker) error {
+		if inv.Key == "nested.selectOne" {
+			return inv.SetRows(columns, rows[:2])
+		}
+		return inv.SetRows(columns, rows)
+	}))
+	trees := make([]*ResourceTree, 0)
+	err = e.Select(&trees, "nested.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the joined rows are collapsed, the null parent and children are not created
+	format := func(tree *ResourceTree) string {
+		ret := fmt.Sprint(tree.ID, tree.Name)
+		if tree.Parent != nil {
+			ret += fmt.Sprint(" parent=", tree.Parent.ID, tree.Parent.Name)
+		}
+		for _, c := range tree.Children {
+			ret += fmt.Sprint(" child=", c.ID, c.Name)
+		}
+		return ret
+	}
+	got := make([]string, 0, len(trees))
+	for _, tree := range trees {
+		got = append(got, format(tree))
+	}
+	if strings.Join(got, "|") != "1a child=2b child=3c|2b parent=1a|4d" {
+		t.Fatal(got)
+	}
+	if trees[1].Children == nil || len(trees[1].Children) != 0 || trees[1].Parent.Parent != nil {
+		t.Fatal(trees[1])
+	}
+	// the rows of one struct with its children is one record
+	var tree ResourceTree
+	err = e.SelectOne(&tree, "nested.selectOne", map[string]int{"ID": 1})
+	if err != nil || format(&tree) != "1a child=2b child=3c" {
+		t.Fatal(err, format(&tree))
+	}
+}
+
+func TestScalar_test(t *testing.T) {
+	var count int64
+	err := eg.SelectOne(&count, "my.count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, 0)
+	err = eg.Select(&ids, "my.selectIds", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(ids)) != count {
+		t.Fatal(count, ids)
+	}
+	err = eg.Select(&ids, "my.selectALL", nil)
+	if err != engine.ERR_NOT_ONE_COLUMN {
+		t.Fatal(err)
+	}
+}
+
+func TestScalarType_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "scalar", map[string][]byte{
+		"scalar.goxml": []byte(`<sqlmap namespace="scalar"><sql id="select">SELECT dsn FROM t</sql></sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dsn []byte
+	err = e.SelectOne(&dsn, "scalar.select", nil)
+	if err != nil || string(dsn) != "scalar" {
+		t.Fatal(err, dsn)
+	}
+	m := map[string]string{}
+	err = e.SelectOne(&m, "scalar.select", nil)
+	if err == nil || err == engine.ERR_NOT_ONE_COLUMN {
+		t.Fatal(err)
+	}
+	slices := make([][]int, 0)
+	err = e.Select(&slices, "scalar.select", nil)
+	if err == nil || err == engine.ERR_NOT_ONE_COLUMN {
+		t.Fatal(err)
+	}
+	var f func()
+	err = e.SelectOne(&f, "scalar.select", nil)
+	if err == nil || err == engine.ERR_NOT_ONE_COLUMN {
+		t.Fatal(err)
+	}
+}
+
+func TestIterate_test(t *testing.T) {
+	cursor, err := eg.Iterate("my.selectALL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cursor.Close()
+	count := 0
+	for cursor.Next() {
+		src := Resource{}
+		err = cursor.Scan(&src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if cursor.Err() != nil {
+		t.Fatal(cursor.Err())
+	}
+
+	each := 0
+	err = eg.Each("my.selectALL", nil, func(src *Resource) error {
+		each++
+		return nil
+	})
+	if err != nil || each != count {
+		t.Fatal(err, each, count)
+	}
+}
+
+func TestEachCallback_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "each", map[string][]byte{
+		"each.goxml": []byte(`<sqlmap namespace="each">
+			<sql id="select">SELECT dsn FROM t</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		DSN string `db:"dsn"`
+	}
+	var nilFunc func(r *row) error
+	for _, fn := range []interface{}{nil, nilFunc, "fn", func(r row) error { return nil }} {
+		err = e.Each("each.select", nil, fn)
+		if err == nil || !strings.Contains(err.Error(), "the each callback must be") {
+			t.Fatal(fn, err)
+		}
+	}
+	if queries := recorder.Queries("each"); len(queries) != 0 {
+		t.Fatal("the sql must not execute with the invalid callback", queries)
+	}
+	var dsns []string
+	err = e.Each("each.select", nil, func(r *row) error {
+		dsns = append(dsns, r.DSN)
+		return nil
+	})
+	if err != nil || len(dsns) != 1 || dsns[0] != "each" {
+		t.Fatal(err, dsns)
+	}
+}
+
 func TestMap_test(t *testing.T) {
 	ret, err := eg.Query("my.selectALL", nil)
 	if err != nil {
@@ -64,6 +622,977 @@ func TestMap_test(t *testing.T) {
 	}
 }
 
+func TestQueryMaps_test(t *testing.T) {
+	ret, err := eg.QueryMaps("my.selectALL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range ret {
+		if _, ok := v["id"].(int64); !ok {
+			t.Fatal(v)
+		}
+		if v["url"] != nil {
+			if _, ok := v["url"].(string); !ok {
+				t.Fatal(v)
+			}
+		}
+	}
+	cols, rows, err := eg.QueryRows("my.selectALL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(ret) || len(cols) == 0 || cols[0] != "id" {
+		t.Fatal(cols, len(rows), len(ret))
+	}
+}
+
+func TestQueryBytes_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "bytes-query", map[string][]byte{
+		"bytes.goxml": []byte(`<sqlmap namespace="bytes">
+			<sql id="select">SELECT dsn FROM t</sql>
+			<sql id="blob">SELECT data, empty, text, missing FROM t</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.RegisterInterceptor(engine.InterceptorFunc(func(ctx context.Context, inv *engine.Invocation, next engine.Invoker) error {
+		if inv.Key == "bytes.blob" {
+			return inv.SetRows([]string{"data", "empty", "text", "missing"}, [][]interface{}{
+				{[]byte{0, 1, 0xff}, []byte{}, "abc", nil},
+			})
+		}
+		return next(ctx, inv)
+	}))
+	rows, err := e.QueryBytes("bytes.select", nil)
+	if err != nil || len(rows) != 1 || !bytes.Equal(rows[0]["dsn"], []byte("bytes-query")) {
+		t.Fatal(err, rows)
+	}
+	rows, err = e.QueryBytes("bytes.blob", nil)
+	if err != nil || len(rows) != 1 {
+		t.Fatal(err, rows)
+	}
+	row := rows[0]
+	if !bytes.Equal(row["data"], []byte{0, 1, 0xff}) || len(row["empty"]) != 0 || string(row["text"]) != "abc" {
+		t.Fatal(row)
+	}
+	// the NULL is the nil bytes with the column key
+	if missing, ok := row["missing"]; !ok || missing != nil {
+		t.Fatal(row)
+	}
+}
+
+func TestColumnType_test(t *testing.T) {
+	files := map[string][]byte{
+		"column.goxml": []byte(`<sqlmap namespace="column"><sql id="select">SELECT dsn FROM t</sql></sqlmap>`),
+	}
+	for _, typ := range []string{"POINT", "INTERVAL", "INT"} {
+		dsn := "column-" + typ
+		recorder.SetType(dsn, typ)
+		e, err := engine.NewEngineBytes("recorder", dsn, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := e.QueryMaps("column.select", nil)
+		if err != nil {
+			t.Fatal(typ, err)
+		}
+		if rows[0]["dsn"] != dsn {
+			t.Fatal(typ, rows)
+		}
+	}
+}
+
+func TestReload_test(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "reload.goxml")
+	write := func(content string) {
+		err := os.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	last := func() string {
+		queries := recorder.Queries("reload")
+		return queries[len(queries)-1]
+	}
+	write(`<sqlmap namespace="reload"><sql id="select">SELECT a FROM t</sql></sqlmap>`)
+	e, err := engine.NewEngine("recorder", "reload", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("reload.select", nil)
+	if err != nil || last() != "SELECT a FROM t" {
+		t.Fatal(err, last())
+	}
+
+	write(`<sqlmap namespace="reload"><sql id="select">SELECT b, c FROM t</sql></sqlmap>`)
+	err = e.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("reload.select", nil)
+	if err != nil || last() != "SELECT b, c FROM t" {
+		t.Fatal(err, last())
+	}
+
+	write(`<sqlmap namespace="reload"><sql id="select">SELECT {{if}} FROM t</sql></sqlmap>`)
+	err = e.Reload()
+	if err == nil {
+		t.Fatal("the broken file must fail to reload")
+	}
+	_, err = e.Query("reload.select", nil)
+	if err != nil || last() != "SELECT b, c FROM t" {
+		t.Fatal(err, last())
+	}
+}
+
+func TestWatch_test(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "watch.goxml")
+	write := func(content string) {
+		err := os.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`<sqlmap namespace="watch"><sql id="select">SELECT a FROM t</sql></sqlmap>`)
+	e, err := engine.NewEngine("recorder", "watch", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &recordLogger{}
+	e.SetLogger(l)
+	err = e.Watch(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Watch(10*time.Millisecond) == nil {
+		t.Fatal("the engine must not watch twice")
+	}
+
+	// the changed file is reloaded by the watcher
+	write(`<sqlmap namespace="watch"><sql id="select">SELECT bb FROM t</sql></sqlmap>`)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err = e.Query("watch.select", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries := recorder.Queries("watch")
+		if queries[len(queries)-1] == "SELECT bb FROM t" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the changed file is not reloaded", queries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// no reload after the watch stop
+	e.StopWatch()
+	reloads := func() int {
+		count := 0
+		for _, msg := range l.Msgs() {
+			if msg == "INFO reload the *.goxml file" {
+				count++
+			}
+		}
+		return count
+	}
+	if reloads() != 1 {
+		t.Fatal(l.Msgs())
+	}
+	write(`<sqlmap namespace="watch"><sql id="select">SELECT ccc FROM t</sql></sqlmap>`)
+	time.Sleep(100 * time.Millisecond)
+	_, err = e.Query("watch.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := recorder.Queries("watch")
+	if queries[len(queries)-1] != "SELECT bb FROM t" || reloads() != 1 {
+		t.Fatal(queries, l.Msgs())
+	}
+}
+
+func TestInitBytes_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "bytes", map[string][]byte{
+		"count.goxml": []byte(`<sqlmap namespace="mem"><sql id="count">SELECT COUNT(*) FROM sys_src</sql></sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("mem.count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := recorder.Queries("bytes")
+	if len(queries) != 1 || queries[0] != "SELECT COUNT(*) FROM sys_src" {
+		t.Fatal(queries)
+	}
+}
+
+func TestInitFS_test(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/a.goxml":     {Data: []byte(`<sqlmap namespace="a"><sql id="select">SELECT a FROM t</sql></sqlmap>`)},
+		"sql/sub/b.goxml": {Data: []byte(`<sqlmap namespace="b"><sql id="select">SELECT b FROM t</sql></sqlmap>`)},
+		"other/c.goxml":   {Data: []byte(`<sqlmap namespace="c"><sql id="select">SELECT c FROM t</sql></sqlmap>`)},
+	}
+	e := engine.New()
+	err := e.InitFS("recorder", "fs", fsys, "sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the files in the sub dir are loaded, the files out of the dir are not
+	for _, key := range []string{"a.select", "b.select"} {
+		_, err = e.Query(key, nil)
+		if err != nil {
+			t.Fatal(key, err)
+		}
+	}
+	_, err = e.Query("c.select", nil)
+	if err == nil {
+		t.Fatal("the file out of the dir must not be loaded")
+	}
+	queries := recorder.Queries("fs")
+	if len(queries) != 2 || queries[0] != "SELECT a FROM t" || queries[1] != "SELECT b FROM t" {
+		t.Fatal(queries)
+	}
+}
+
+func TestInitReader_test(t *testing.T) {
+	e := engine.New()
+	err := e.InitReader("recorder", "reader", "reader.goxml", strings.NewReader(`<sqlmap namespace="reader">
+		<sql id="select">SELECT a FROM t WHERE id = #{Id}</sql>
+	</sqlmap>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("reader.select", map[string]int{"Id": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := recorder.Queries("reader")
+	if len(queries) != 1 || queries[0] != "SELECT a FROM t WHERE id = ?" {
+		t.Fatal(queries)
+	}
+	// the name is in the error message
+	_, err = engine.NewEngineReader("recorder", "reader", "broken.goxml", strings.NewReader(`<sqlmap namespace="broken"><sql>`))
+	if err == nil || !strings.Contains(err.Error(), "broken.goxml") {
+		t.Fatal(err)
+	}
+}
+
+func TestStatementAttrs_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "attrs", map[string][]byte{
+		"attrs.goxml": []byte(`<sqlmap namespace="attrs">
+			<sql id="selectIds" type="select" maxRows="2" fetchSize="100">SELECT id FROM sys_src</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetchSize := 0
+	e.RegisterInterceptor(engine.InterceptorFunc(func(ctx context.Context, inv *engine.Invocation, next engine.Invoker) error {
+		fetchSize = inv.FetchSize
+		return inv.SetRows([]string{"id"}, [][]interface{}{{int64(1)}, {int64(2)}, {int64(3)}})
+	}))
+	ids := make([]int64, 0)
+	err = e.Select(&ids, "attrs.selectIds", nil)
+	if err != engine.ERR_TOO_MANY_ROWS {
+		t.Fatal(err)
+	}
+	if fetchSize != 100 {
+		t.Fatal(fetchSize)
+	}
+	_, err = e.Execute("attrs.selectIds", nil)
+	if err != engine.ERR_NOT_EXEC_STATEMENT {
+		t.Fatal(err)
+	}
+}
+
+func TestCache_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "cache", map[string][]byte{
+		"cache.goxml": []byte(`<sqlmap namespace="cache">
+			<sql id="select" useCache="true" ttl="30s">SELECT * FROM sys_src WHERE id = #{ID}</sql>
+			<sql id="update" type="update" flushCache="true">UPDATE sys_src SET seq = 1</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selects := func() int {
+		count := 0
+		for _, q := range recorder.Queries("cache") {
+			if strings.HasPrefix(q, "SELECT") {
+				count++
+			}
+		}
+		return count
+	}
+	first, second := 1, 1
+	_, err = e.Query("cache.select", map[string]*int{"ID": &first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("cache.select", map[string]*int{"ID": &second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selects() != 1 {
+		t.Fatal("the second query must hit the cache", recorder.Queries("cache"))
+	}
+	_, err = e.Execute("cache.update", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Query("cache.select", map[string]*int{"ID": &first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selects() != 2 {
+		t.Fatal("the query after the write must not hit the cache", recorder.Queries("cache"))
+	}
+}
+
+func TestInterceptor_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "interceptor", map[string][]byte{
+		"interceptor.goxml": []byte(`<sqlmap namespace="interceptor">
+			<sql id="select">SELECT dsn FROM t WHERE id = #{Id}</sql>
+			<sql id="update">UPDATE t SET a = 1</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0)
+	fail := errors.New("fail")
+	e.RegisterInterceptor(engine.InterceptorFunc(func(ctx context.Context, inv *engine.Invocation, next engine.Invoker) error {
+		keys = append(keys, fmt.Sprint(inv.Key, " ", inv.Operation, " ", inv.SQL, " ", inv.Args))
+		if inv.Operation == engine.OperationExec {
+			return fail
+		}
+		// the interceptor can modify the sql before call next
+		inv.SQL += " LIMIT 1"
+		return next(ctx, inv)
+	}))
+	var name string
+	err = e.SelectOne(&name, "interceptor.select", map[string]int{"Id": 1})
+	if err != nil || name != "interceptor" {
+		t.Fatal(err, name)
+	}
+	_, err = e.Execute("interceptor.update", nil)
+	if err != fail {
+		t.Fatal(err)
+	}
+	want := "interceptor.select query SELECT dsn FROM t WHERE id = ? [1]|interceptor.update exec UPDATE t SET a = 1 []"
+	if strings.Join(keys, "|") != want {
+		t.Fatal(keys)
+	}
+	// the exec stopped by the interceptor is not executed
+	queries := recorder.Queries("interceptor")
+	if len(queries) != 1 || queries[0] != "SELECT dsn FROM t WHERE id = ? LIMIT 1" {
+		t.Fatal(queries)
+	}
+}
+
+type recordLogger struct {
+	lock   sync.Mutex
+	levels []log.Level
+	msgs   []string
+}
+
+func (l *recordLogger) Enabled(level log.Level) bool {
+	return true
+}
+
+func (l *recordLogger) Log(ctx context.Context, level log.Level, msg string, fields ...log.Field) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.levels = append(l.levels, level)
+	l.msgs = append(l.msgs, level.String()+" "+msg)
+}
+
+/// get the logged messages with the level, eg: INFO execute sql
+func (l *recordLogger) Msgs() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string{}, l.msgs...)
+}
+
+func TestLogger_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "logger", map[string][]byte{
+		"logger.goxml": []byte(`<sqlmap namespace="logger">
+			<sql id="select">SELECT dsn FROM t</sql>
+			<sql id="empty">SELECT dsn FROM t WHERE 1 = 0</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &recordLogger{}
+	e.SetLogger(l)
+	e.SetSlowThreshold(time.Nanosecond)
+	var name string
+	err = e.SelectOne(&name, "logger.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.levels) != 1 || l.levels[0] != log.LevelWarn {
+		t.Fatal(l.msgs)
+	}
+
+	// the not got record of SelectOne is not an error of the execution
+	e.SetSlowThreshold(0)
+	r := &recordTracer{}
+	e.SetTracer(r)
+	e.RegisterInterceptor(engine.InterceptorFunc(func(ctx context.Context, inv *engine.Invocation, next engine.Invoker) error {
+		if inv.Key == "logger.empty" {
+			return inv.SetRows([]string{"dsn"}, nil)
+		}
+		return next(ctx, inv)
+	}))
+	err = e.SelectOne(&name, "logger.empty", nil)
+	if err != engine.ERR_NOT_GOT_RECORD {
+		t.Fatal(err)
+	}
+	if len(l.msgs) != 2 || l.msgs[1] != "INFO execute sql" {
+		t.Fatal(l.msgs)
+	}
+	if len(r.ends) != 1 || r.ends[0] != "sqlmap.query <nil>" {
+		t.Fatal(r.ends)
+	}
+	m := e.Metrics()
+	if len(m.Statements) != 2 || m.Statements[0].Key != "logger.empty" || m.Statements[0].Errors != 0 {
+		t.Fatal(m.Statements)
+	}
+}
+
+/// the response writer that fail to write the body
+type failResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *failResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *failResponseWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func (w *failResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func TestMetrics_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "metrics", map[string][]byte{
+		"metrics.goxml": []byte(`<sqlmap namespace="metrics">
+			<sql id="select">SELECT dsn FROM t</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := sql.Open("recorder", "metrics-replica")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.AddReplica(replica, 1)
+	var name string
+	err = e.SelectOne(&name, "metrics.select", nil)
+	if err != nil || name != "metrics-replica" {
+		t.Fatal(err, name)
+	}
+	m := e.Metrics()
+	if len(m.Statements) != 1 || m.Statements[0].Key != "metrics.select" || m.Statements[0].Calls != 1 || m.Statements[0].Rows != 1 {
+		t.Fatal(m.Statements)
+	}
+	if len(m.Replicas) != 1 || m.Replicas[0].OpenConnections != 1 {
+		t.Fatal(m.Replicas)
+	}
+	buf := &bytes.Buffer{}
+	err = e.WriteMetrics(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`sqlmap_statement_duration_seconds_count{key="metrics.select"} 1`,
+		`sqlmap_pool_open_connections{pool="primary"} `,
+		`sqlmap_pool_open_connections{pool="replica-0"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatal(want, buf.String())
+		}
+	}
+
+	// serve the metrics by the handler
+	rec := httptest.NewRecorder()
+	e.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(rec.Body.String(), `sqlmap_statement_calls_total{key="metrics.select"} 1`) {
+		t.Fatal(rec.Code, rec.Body.String())
+	}
+	// the error of writing the response is logged
+	l := &recordLogger{}
+	e.SetLogger(l)
+	e.MetricsHandler().ServeHTTP(&failResponseWriter{header: http.Header{}}, httptest.NewRequest("GET", "/metrics", nil))
+	if len(l.msgs) != 1 || l.msgs[0] != "ERROR write metrics fail" {
+		t.Fatal(l.msgs)
+	}
+}
+
+/// the tracer that record the started spans as "name parent", the parent is the span in the ctx,
+/// the trace ID is the name of the root span
+type recordTracer struct {
+	lock  sync.Mutex
+	spans []string // the started spans, eg: sqlmap.query sqlmap.transaction
+	ends  []string // the ended spans with the error, eg: sqlmap.query <nil>
+}
+
+type recordSpanKey struct{}
+
+type recordSpan struct {
+	tracer *recordTracer
+	name   string
+	trace  string
+}
+
+func (r *recordTracer) Start(ctx context.Context, name string, attrs ...engine.Attribute) (context.Context, engine.Span) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	span := &recordSpan{tracer: r, name: name, trace: name}
+	parent := "-"
+	if p, ok := ctx.Value(recordSpanKey{}).(*recordSpan); ok {
+		span.trace = p.trace
+		parent = p.name
+	}
+	r.spans = append(r.spans, name+" "+parent)
+	return context.WithValue(ctx, recordSpanKey{}, span), span
+}
+
+func (r *recordTracer) TraceID(ctx context.Context) string {
+	if span, ok := ctx.Value(recordSpanKey{}).(*recordSpan); ok {
+		return span.trace
+	}
+	return ""
+}
+
+func (s *recordSpan) SetAttributes(attrs ...engine.Attribute) {
+}
+
+func (s *recordSpan) End(err error) {
+	s.tracer.lock.Lock()
+	defer s.tracer.lock.Unlock()
+	s.tracer.ends = append(s.tracer.ends, fmt.Sprint(s.name, " ", err))
+}
+
+func TestTracer_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "tracer", map[string][]byte{
+		"tracer.goxml": []byte(`<sqlmap namespace="tracer">
+			<sql id="select">SELECT a FROM t WHERE id = #{Id}</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &recordTracer{}
+	e.SetTracer(r)
+	e.SetSqlComment(true)
+	ctx, _ := r.Start(context.Background(), "request")
+	// the statement span in the transaction is the child of the transaction span, even the ctx of the statement has no span
+	_, err = e.TransactionTx(ctx, nil, func(session *engine.Session) (interface{}, error) {
+		return session.QueryContext(context.Background(), "tracer.select", map[string]int{"Id": 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.QueryContext(ctx, "tracer.select", map[string]int{"Id": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "request -|sqlmap.transaction request|sqlmap.query sqlmap.transaction|sqlmap.query request"
+	if strings.Join(r.spans, "|") != want {
+		t.Fatal(r.spans)
+	}
+	want = "sqlmap.query <nil>|sqlmap.transaction <nil>|sqlmap.query <nil>"
+	if strings.Join(r.ends, "|") != want {
+		t.Fatal(r.ends)
+	}
+	queries := recorder.Queries("tracer")
+	want = "SELECT a FROM t WHERE id = ? /* key=tracer.select, trace_id=request */"
+	if len(queries) != 2 || queries[0] != want || queries[1] != want {
+		t.Fatal(queries)
+	}
+}
+
+func TestTransactionRollback_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "txrollback", map[string][]byte{
+		"txrollback.goxml": []byte(`<sqlmap namespace="txrollback">
+			<sql id="select">SELECT dsn FROM t</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.GetDB().SetMaxOpenConns(1)
+	fail := errors.New("fail")
+	_, err = e.Transaction(func(session *engine.Session) (interface{}, error) {
+		var name string
+		err := session.SelectOne(&name, "txrollback.select", nil)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fail
+	})
+	if err != fail {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() {
+			if p := recover(); p != fail {
+				t.Fatal("the panic must be raised again", p)
+			}
+		}()
+		e.Transaction(func(session *engine.Session) (interface{}, error) {
+			panic(fail)
+		})
+	}()
+	// the connection is released by the rollback, the query wait for it until the timeout if not
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var name string
+	err = e.SelectOneContext(ctx, &name, "txrollback.select", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1 BEGIN|1 SELECT dsn FROM t|1 ROLLBACK|1 BEGIN|1 ROLLBACK|1 SELECT dsn FROM t"
+	if events := recorder.Events("txrollback"); strings.Join(events, "|") != want {
+		t.Fatal(events)
+	}
+}
+
+func TestRollbackError_test(t *testing.T) {
+	fail := errors.New("fail")
+	var err error = &engine.RollbackError{Err: fail, RollbackErr: &net.OpError{Op: "write", Err: sql.ErrConnDone}}
+	if !errors.Is(err, fail) || !errors.Is(err, sql.ErrConnDone) {
+		t.Fatal(err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "write" {
+		t.Fatal(err)
+	}
+	var rbErr *engine.RollbackError
+	if !errors.As(err, &rbErr) || rbErr.Err != fail {
+		t.Fatal(err)
+	}
+}
+
+func TestPropagation_test(t *testing.T) {
+	fail := errors.New("fail")
+	_, err := eg.Transaction(func(session *engine.Session) (interface{}, error) {
+		_, err := session.Transaction(engine.PropagationRequired, func(session *engine.Session) (interface{}, error) {
+			return nil, fail
+		})
+		if err != fail || !session.IsRollbackOnly() {
+			t.Fatal(err)
+		}
+		return session.Transaction(engine.PropagationNever, func(session *engine.Session) (interface{}, error) {
+			return nil, nil
+		})
+	})
+	if err != engine.ERR_TX_EXISTS {
+		t.Fatal(err)
+	}
+	_, err = eg.Transaction(func(session *engine.Session) (interface{}, error) {
+		// the inner failure is ignored but the outer commit still rollback
+		session.Transaction(engine.PropagationRequired, func(session *engine.Session) (interface{}, error) {
+			return nil, fail
+		})
+		return nil, nil
+	})
+	if err != engine.ERR_ROLLBACK_ONLY {
+		t.Fatal(err)
+	}
+}
+
+func TestPropagationScope_test(t *testing.T) {
+	files := map[string][]byte{
+		"scope.goxml": []byte(`<sqlmap namespace="scope">
+			<sql id="insert" type="insert">INSERT INTO t VALUES (#{.})</sql>
+		</sqlmap>`),
+	}
+	assertEvents := func(dsn string, want ...string) {
+		events := recorder.Events(dsn)
+		if strings.Join(events, "; ") != strings.Join(want, "; ") {
+			t.Fatal(events)
+		}
+	}
+	fail := errors.New("fail")
+
+	// the requires new scope commit on another connection though the outer rollback
+	e, err := engine.NewEngineBytes("recorder", "scope-requires-new", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Transaction(func(session *engine.Session) (interface{}, error) {
+		_, err := session.Exec("scope.insert", 1)
+		if err != nil {
+			return nil, err
+		}
+		_, err = session.Transaction(engine.PropagationRequiresNew, func(session *engine.Session) (interface{}, error) {
+			return session.Exec("scope.insert", 2)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return nil, fail
+	})
+	if err != fail {
+		t.Fatal(err)
+	}
+	assertEvents("scope-requires-new", "1 BEGIN", "1 INSERT INTO t VALUES (?)",
+		"2 BEGIN", "2 INSERT INTO t VALUES (?)", "2 COMMIT", "1 ROLLBACK")
+
+	// the nested scope rollback to its savepoint only
+	e, err = engine.NewEngineBytes("recorder", "scope-nested", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.Transaction(func(session *engine.Session) (interface{}, error) {
+		_, err := session.Exec("scope.insert", 1)
+		if err != nil {
+			return nil, err
+		}
+		_, err = session.Transaction(engine.PropagationNested, func(session *engine.Session) (interface{}, error) {
+			_, err := session.Exec("scope.insert", 2)
+			if err != nil {
+				return nil, err
+			}
+			return nil, fail
+		})
+		if err != fail {
+			return nil, err
+		}
+		return session.Exec("scope.insert", 3)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEvents("scope-nested", "1 BEGIN", "1 INSERT INTO t VALUES (?)", "1 SAVEPOINT sqlmap_sp_1",
+		"1 INSERT INTO t VALUES (?)", "1 ROLLBACK TO SAVEPOINT sqlmap_sp_1", "1 INSERT INTO t VALUES (?)", "1 COMMIT")
+
+	// the commit of the inner scope not disable the rollback of the outer scope
+	e, err = engine.NewEngineBytes("recorder", "scope-commit", files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := e.NewSession()
+	err = session.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = session.Exec("scope.insert", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = session.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEvents("scope-commit", "1 BEGIN", "1 INSERT INTO t VALUES (?)", "1 ROLLBACK")
+}
+
+func TestSavepoint_test(t *testing.T) {
+	files := map[string][]byte{
+		"savepoint.goxml": []byte(`<sqlmap namespace="savepoint"></sqlmap>`),
+	}
+	standard := "1 BEGIN|1 SAVEPOINT batch|1 ROLLBACK TO SAVEPOINT batch|1 RELEASE SAVEPOINT batch|" +
+		"1 SAVEPOINT sqlmap_sp_1|1 RELEASE SAVEPOINT sqlmap_sp_1|1 SAVEPOINT sqlmap_sp_2|1 ROLLBACK TO SAVEPOINT sqlmap_sp_2|1 COMMIT"
+	cases := map[engine.Dialect]string{
+		engine.MySQL:    standard,
+		engine.Postgres: standard,
+		// the savepoint is released when the transaction end
+		engine.Oracle: "1 BEGIN|1 SAVEPOINT batch|1 ROLLBACK TO SAVEPOINT batch|" +
+			"1 SAVEPOINT sqlmap_sp_1|1 SAVEPOINT sqlmap_sp_2|1 ROLLBACK TO SAVEPOINT sqlmap_sp_2|1 COMMIT",
+		engine.SQLServer: "1 BEGIN|1 SAVE TRANSACTION batch|1 ROLLBACK TRANSACTION batch|" +
+			"1 SAVE TRANSACTION sqlmap_sp_1|1 SAVE TRANSACTION sqlmap_sp_2|1 ROLLBACK TRANSACTION sqlmap_sp_2|1 COMMIT",
+	}
+	for d, want := range cases {
+		dsn := "savepoint-" + d.Name()
+		e := engine.New()
+		e.SetDialect(d)
+		err := e.InitBytes("recorder", dsn, files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := e.NewSession()
+		err = session.Savepoint("batch")
+		if err != engine.ERR_NO_TX {
+			t.Fatal(err)
+		}
+		err = session.BeginTx()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = session.Savepoint("batch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = session.RollbackTo("batch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = session.ReleaseSavepoint("batch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the nested scopes create the savepoints, the commit release it and the rollback rollback to it
+		for _, commit := range []bool{true, false} {
+			err = session.BeginTxPropagation(context.Background(), nil, engine.PropagationNested)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit {
+				err = session.Commit()
+			} else {
+				err = session.Rollback()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = session.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if events := recorder.Events(dsn); strings.Join(events, "|") != want {
+			t.Fatal(d.Name(), events)
+		}
+	}
+}
+
+func TestTransactionContext_test(t *testing.T) {
+	fail := errors.New("fail")
+	src := &Resource{Type: "menu", Name: "ambient", Code: "ambient_tx_test"}
+	count := func(ctx context.Context) (int64, error) {
+		var count int64
+		err := eg.SelectOneContext(ctx, &count, "my.countByCode", src)
+		return count, err
+	}
+	err := eg.TransactionContext(context.Background(), func(ctx context.Context) error {
+		_, err := eg.ExecuteContext(ctx, "my.insertSrc", src)
+		if err != nil {
+			return err
+		}
+		// the row is visible in the transaction carried by the ctx only
+		if n, err := count(ctx); err != nil || n != 1 {
+			return fmt.Errorf("the row must be visible with the ctx: %d %v", n, err)
+		}
+		if n, err := count(context.Background()); err != nil || n != 0 {
+			return fmt.Errorf("the row must be invisible outside the transaction: %d %v", n, err)
+		}
+		return eg.TransactionContext(ctx, func(ctx context.Context) error {
+			return fail
+		})
+	})
+	if err != fail {
+		t.Fatal(err)
+	}
+	if n, err := count(context.Background()); err != nil || n != 0 {
+		t.Fatal("the row must be rollback", n, err)
+	}
+}
+
+func TestReplica_test(t *testing.T) {
+	e, err := engine.NewEngineBytes("recorder", "replica-master", map[string][]byte{
+		"replica.goxml": []byte(`<sqlmap namespace="replica">
+			<sql id="select">SELECT dsn FROM t</sql>
+			<sql id="selectMaster" useMaster="true">SELECT dsn FROM t</sql>
+			<sql id="selectCached" useCache="true">SELECT dsn FROM t</sql>
+		</sqlmap>`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := func(dsn string) *sql.DB {
+		db, err := sql.Open("recorder", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	// the dsn of the db that serve the query is returned as the row
+	route := func(ctx context.Context, key string, n int) string {
+		dbs := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			var dsn string
+			err := e.SelectOneContext(ctx, &dsn, key, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbs = append(dbs, dsn)
+		}
+		return strings.Join(dbs, ",")
+	}
+	e.AddReplica(open("replica-1"), 2)
+	e.AddReplica(open("replica-2"), 1)
+
+	ctx := context.Background()
+	if dbs := route(ctx, "replica.select", 4); dbs != "replica-1,replica-2,replica-1,replica-2" {
+		t.Fatal("round-robin", dbs)
+	}
+	e.SetReplicaPolicy(engine.ReplicaWeighted)
+	if dbs := route(ctx, "replica.select", 6); dbs != "replica-1,replica-2,replica-1,replica-1,replica-2,replica-1" {
+		t.Fatal("weighted", dbs)
+	}
+	if dbs := route(ctx, "replica.selectMaster", 2); dbs != "replica-master,replica-master" {
+		t.Fatal("useMaster attribute", dbs)
+	}
+	if dbs := route(engine.UseMaster(ctx), "replica.select", 2); dbs != "replica-master,replica-master" {
+		t.Fatal("UseMaster ctx", dbs)
+	}
+	// the cached replica result is not served to the query routed to the primary
+	if dbs := route(ctx, "replica.selectCached", 1); dbs != "replica-1" {
+		t.Fatal("cached", dbs)
+	}
+	if dbs := route(engine.UseMaster(ctx), "replica.selectCached", 1); dbs != "replica-master" {
+		t.Fatal("cached with UseMaster ctx", dbs)
+	}
+
+	// the unhealthy replica is evicted and the primary serve the queries if all are evicted
+	recorder.SetDown("replica-1", true)
+	e.CheckReplicas(ctx)
+	if dbs := route(ctx, "replica.select", 2); dbs != "replica-2,replica-2" {
+		t.Fatal("evicted", dbs)
+	}
+	recorder.SetDown("replica-2", true)
+	e.CheckReplicas(ctx)
+	if dbs := route(ctx, "replica.select", 1); dbs != "replica-master" {
+		t.Fatal("all evicted", dbs)
+	}
+	recorder.SetDown("replica-1", false)
+	recorder.SetDown("replica-2", false)
+	e.CheckReplicas(ctx)
+	if dbs := route(ctx, "replica.select", 1); dbs != "replica-1" {
+		t.Fatal("restored", dbs)
+	}
+	// the health check not change the health keep the weighted sequence
+	e.CheckReplicas(ctx)
+	if dbs := route(ctx, "replica.select", 2); dbs != "replica-2,replica-1" {
+		t.Fatal("weighted after check", dbs)
+	}
+}
+
 func TestConcurrency_test(t *testing.T)  {
 	wg.Add(1)
 	go TestSliceStruct_test(nil)
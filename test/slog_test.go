@@ -0,0 +1,26 @@
+//go:build go1.21
+// +build go1.21
+
+package test
+
+import (
+	"bytes"
+	"context"
+	"github.com/zhaobingss/sqlmap/log"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger_test(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := log.NewSlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	if l.Enabled(log.LevelInfo) || !l.Enabled(log.LevelWarn) || !l.Enabled(log.LevelError) {
+		t.Fatal("the level must follow the slog handler")
+	}
+	l.Log(context.Background(), log.LevelWarn, "slow sql", log.F("key", "my.select"), log.F("rows", 2))
+	out := buf.String()
+	if !strings.Contains(out, `level=WARN msg="slow sql" key=my.select rows=2`) {
+		t.Fatal(out)
+	}
+}